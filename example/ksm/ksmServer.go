@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/dsggregory/yubiv/pkg/ksm"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	var keyFile, addr string
+	flag.StringVar(&keyFile, "k", "ksm-keys.yaml", "Path to the YAML file of Yubikey AES keys")
+	flag.StringVar(&addr, "l", "127.0.0.1:8081", "Address to listen on")
+	flag.Parse()
+
+	// Production deployments keep the key file readable only by the KSM, on a host apart from the validation service.
+	keys := ksm.NewMapKeyStore()
+	if err := keys.LoadKeyFile(keyFile); err != nil {
+		log.Fatal(err)
+	}
+
+	http.Handle(ksm.DecryptPath, ksm.NewHandler(keys))
+	log.WithField("addr", addr).Info("serving " + ksm.DecryptPath)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	var dbPath string
+	var check, printSQL bool
+	flag.StringVar(&dbPath, "d", "file:///tmp/yubiuser.db", "DSN of the database")
+	flag.BoolVar(&check, "check", false, "List the pending migrations and exit with status 1 if there are any")
+	flag.BoolVar(&printSQL, "sql", false, "Print the SQL of the pending migrations, for review, instead of applying them")
+	flag.Parse()
+
+	ctx := context.Background()
+	db, err := yubidb.OpenDb(dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	version, err := db.SchemaVersion(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pending, err := db.PendingMigrations(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.WithFields(log.Fields{"dialect": db.Dialect(), "version": version, "pending": len(pending)}).
+		Info("database schema")
+
+	switch {
+	case check:
+		for _, m := range pending {
+			fmt.Printf("%04d %s\n", m.Version, m.Name)
+		}
+		if len(pending) > 0 {
+			os.Exit(1)
+		}
+	case printSQL:
+		for _, m := range pending {
+			fmt.Printf("-- migration %04d %s\n%s\n", m.Version, m.Name, m.SQL)
+		}
+	default:
+		if err = db.Migrate(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
 
+	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
+	"github.com/dsggregory/yubiv/pkg/selfhosted/keyprovider"
 	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
 
 	"github.com/dsggregory/yubiv/pkg/selfhosted"
+	"github.com/dsggregory/yubiv/pkg/yubico"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -20,8 +25,11 @@ type OpStr struct {
 	dbPath     string
 	addUser    bool
 	printUsers bool
+	cloud      bool
 	otp        string
 	secret     string
+	kekFile    string
+	vaultKey   string
 
 	y *selfhosted.YubiAuth
 }
@@ -38,12 +46,33 @@ func gets(prompt string) (string, error) {
 	return resp, nil
 }
 
-// printAllUsers prints all user records from the database
+// keyProvider returns the provider of the key-encryption key of the options
+func (o *OpStr) keyProvider() (model.KeyProvider, error) {
+	switch {
+	case o.vaultKey != "":
+		return keyprovider.VaultTransitFromEnv(o.vaultKey)
+	case o.kekFile != "":
+		return keyprovider.FromFile(o.kekFile)
+	}
+	kp, err := keyprovider.FromEnv(keyprovider.KEKEnv)
+	if err != nil {
+		return nil, fmt.Errorf("%w; generate a key-encryption key with `openssl rand -base64 32`", err)
+	}
+	return kp, nil
+}
+
+// printAllUsers prints all user records, and their devices, from the database
 func (o *OpStr) printAllUsers() {
-	users, err := o.y.GetDB().GetAll()
+	ctx := context.Background()
+	users, err := o.y.GetDB().GetAllUsers(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for i := range users {
+		if users[i], err = o.y.GetDB().GetUser(ctx, users[i].ID); err != nil {
+			log.Fatal(err)
+		}
+	}
 	js, err := json.MarshalIndent(users, "", "  ")
 	if err != nil {
 		log.Fatal(err)
@@ -51,39 +80,67 @@ func (o *OpStr) printAllUsers() {
 	fmt.Println(string(js))
 }
 
-// addDeviceUser add a user and their Yubikey to the database.
+// findUser returns the user with the email, adding one when there is none
+func (o *OpStr) findUser(email string) *model.User {
+	ctx := context.Background()
+	u, err := o.y.GetDB().GetUserByEmail(ctx, email)
+	if errors.Is(err, yubidb.ErrNotFound) {
+		u, err = o.y.GetDB().AddUser(ctx, model.User{IsEnabled: true, Email: email})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return u
+}
+
+// addDeviceUser add a Yubikey to the database, and its user if they are new.
 func (o *OpStr) addDeviceUser() {
 	otp, err := gets("Press Yubi device (from device to add): ")
 	if err != nil {
 		log.Fatal(err)
 	}
 	yubiID := otp[:selfhosted.PubLen]
-	if exu, _ := o.y.GetDB().Get(yubiID); exu != nil {
-		js, err := json.MarshalIndent(exu, "", "  ")
+	if exd, _ := o.y.GetDB().GetDevice(context.Background(), yubiID); exd != nil {
+		js, err := json.MarshalIndent(exd, "", "  ")
 		if err != nil {
 			log.Fatal(err)
 		}
 		fmt.Println(string(js))
-		log.Fatal("user already exists")
+		log.Fatal("device already exists")
 	}
 
-	secret, err := gets("Enter secret for device to add: ")
+	secret, err := gets("Enter secret for device to add (empty to validate it with YubiCloud): ")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	email, err := gets("Enter email of user to add: ")
+	privateID, err := gets("Enter private ID for device to add (optional): ")
 	if err != nil {
 		log.Fatal(err)
 	}
+	if privateID, err = model.NormalizePrivateID(privateID); err != nil {
+		log.Fatal(err)
+	}
 
-	u := model.YubiUser{
+	label, err := gets("Enter label for device to add (ex. primary, backup): ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	email, err := gets("Enter email of the device's user: ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d := model.Device{
+		UserID:    o.findUser(email).ID,
+		Label:     label,
 		IsEnabled: true,
 		Public:    yubiID,
 		Secret:    model.ColumnSecret(secret),
-		Email:     email,
+		PrivateID: model.ColumnSecret(privateID),
 	}
-	if err = o.y.GetDB().Add(u); err != nil {
+	if err = o.y.GetDB().AddDevice(context.Background(), d); err != nil {
 		log.Fatal(err)
 	}
 	o.printAllUsers()
@@ -92,14 +149,19 @@ func (o *OpStr) addDeviceUser() {
 // validate a Yubi key press (OTP) against known devices in the DB
 func (o *OpStr) validate() {
 	otp, err := gets("Enter Yubi token to verify: ")
-	o.y.SetToken(otp)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	user, err := o.y.Validate()
+	user, device, err := o.y.ValidateOTP(context.Background(), otp)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("OTP Validated: user record of device to follow")
-	js, err := json.MarshalIndent(user, "", "  ")
+	fmt.Println("OTP Validated: user record and device to follow")
+	js, err := json.MarshalIndent(struct {
+		User   *model.User   `json:"user"`
+		Device *model.Device `json:"device"`
+	}{user, device}, "", "  ")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -110,21 +172,42 @@ func main() {
 	opts := OpStr{}
 
 	flag.StringVar(&opts.dbPath, "d", "file:///tmp/yubiuser.db", "Path to the sqlite3 DB")
-	flag.BoolVar(&opts.addUser, "a", false, "Add a user (Yubi device) instead of verify OTP")
+	flag.BoolVar(&opts.addUser, "a", false, "Add a Yubi device, and its user if new, instead of verify OTP")
 	flag.BoolVar(&opts.printUsers, "p", false, "Print all users")
+	flag.BoolVar(&opts.cloud, "cloud", false, "Validate devices registered without a secret with YubiCloud. Reads the API creds from YUBICO_API_CLIENT_ID and YUBICO_API_SECRET_KEY.")
+	flag.StringVar(&opts.kekFile, "kek-file", "", "File of the base64 key-encryption key. Default is the environment variable "+keyprovider.KEKEnv+".")
+	flag.StringVar(&opts.vaultKey, "vault-key", "", "Name of the Vault Transit key that wraps the data keys instead of a local key-encryption key. Reads VAULT_ADDR and VAULT_TOKEN.")
 	flag.Parse()
 
+	// The secrets in the DB are encrypted with a data key per record, wrapped by a key-encryption key (KEK) that stays in
+	// Vault or is read from a file, such as a k8s secret, or from the environment.
+	kp, err := opts.keyProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := []func(y *selfhosted.YubiAuth){
+		selfhosted.WithDSN(opts.dbPath),
+		selfhosted.WithKeyProvider(kp),
+	}
+	// the column key is only needed to read the secrets written by earlier versions of this example
+	if dbEncKey, ok := os.LookupEnv(model.ColumnKeyEnv); ok {
+		options = append(options, selfhosted.WithColumnKeyFunc(func() string {
+			return dbEncKey
+		}))
+	}
+	if opts.cloud {
+		yc, err := yubico.NewYubiClient(yubico.WithAPIEnvironment())
+		if err != nil {
+			log.Fatal(err)
+		}
+		options = append(options, selfhosted.WithYubiCloud(yc))
+	}
+
 	// This will create the tables if necessary and return an object for you to use to manage self-hosted users and verify OTPs
-	y, err := selfhosted.NewYubiAuth(opts.dbPath)
+	y, err := selfhosted.NewYubiAuth(options...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// Specify the secret DB column encryption key for this application.
-	// WARNING: Real world production code should get this value from vault, k8s secret, et.al.
-	dbEncKey := "foobar"
-	y.GetDB().SetSecretColumnKeyFunc(func() string {
-		return dbEncKey
-	})
 	opts.y = y
 
 	if opts.addUser {
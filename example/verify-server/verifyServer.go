@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/dsggregory/yubiv/pkg/selfhosted"
+	"github.com/dsggregory/yubiv/pkg/selfhosted/keyprovider"
+	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// keyProvider returns the KMS of the key-encryption key, as the self-hosted example does, so that the server reads
+// the databases written by it
+func keyProvider(kekFile string, vaultKey string) (model.KeyProvider, error) {
+	switch {
+	case vaultKey != "":
+		return keyprovider.VaultTransitFromEnv(vaultKey)
+	case kekFile != "":
+		return keyprovider.FromFile(kekFile)
+	}
+	kp, err := keyprovider.FromEnv(keyprovider.KEKEnv)
+	if err != nil {
+		return nil, fmt.Errorf("%w; generate a key-encryption key with `openssl rand -base64 32`", err)
+	}
+	return kp, nil
+}
+
+// addClient registers a new API client and prints its id and key
+func addClient(y *selfhosted.YubiAuth, owner string) {
+	ctx := context.Background()
+	clients, err := y.GetDB().GetAllClients(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the next id after the highest one, so that the id of a deleted client is not reused
+	id := 0
+	for _, c := range clients {
+		if n, err := strconv.Atoi(c.ClientID); err == nil && n > id {
+			id = n
+		}
+	}
+	secret, err := model.GenerateAPIKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := model.APIClient{
+		ClientID:  strconv.Itoa(id + 1),
+		Secret:    model.ColumnSecret(secret),
+		IsEnabled: true,
+		Owner:     owner,
+	}
+	if err = y.GetDB().AddClient(ctx, client); err != nil {
+		log.Fatal(err)
+	}
+	js, err := json.MarshalIndent(client, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(js))
+}
+
+func main() {
+	var dbPath, addr, owner, kekFile, vaultKey string
+	flag.StringVar(&dbPath, "d", "file:///tmp/yubiuser.db", "Path to the sqlite3 DB")
+	flag.StringVar(&addr, "l", ":8080", "Address to listen on")
+	flag.StringVar(&owner, "add-client", "", "Register an API client for this owner instead of serving")
+	flag.StringVar(&kekFile, "kek-file", "", "File of the base64 key-encryption key. Default is the environment variable "+keyprovider.KEKEnv+".")
+	flag.StringVar(&vaultKey, "vault-key", "", "Name of the Vault Transit key that wraps the data keys instead of a local key-encryption key. Reads VAULT_ADDR and VAULT_TOKEN.")
+	flag.Parse()
+
+	// The secrets in the DB are encrypted with a data key per record, wrapped by a key-encryption key (KEK) that stays in
+	// Vault or is read from a file, such as a k8s secret, or from the environment.
+	kp, err := keyProvider(kekFile, vaultKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := []func(y *selfhosted.YubiAuth){
+		selfhosted.WithDSN(dbPath),
+		selfhosted.WithKeyProvider(kp),
+	}
+	// the column key is only needed to read the secrets written by earlier versions of the examples
+	if dbEncKey, ok := os.LookupEnv(model.ColumnKeyEnv); ok {
+		options = append(options, selfhosted.WithColumnKeyFunc(func() string {
+			return dbEncKey
+		}))
+	}
+	y, err := selfhosted.NewYubiAuth(options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if owner != "" {
+		addClient(y, owner)
+		return
+	}
+
+	http.Handle(selfhosted.VerifyPath, selfhosted.NewVerifyHandler(y, selfhosted.DatabaseKeys(y.GetDB())))
+	log.WithField("addr", addr).Info("serving " + selfhosted.VerifyPath)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
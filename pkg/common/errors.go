@@ -0,0 +1,92 @@
+package common
+
+import (
+	"errors"
+	"strings"
+)
+
+// ValidationError the error of an OTP that did not validate. It carries the Status reported for the OTP, the Yubikey ID
+// when it is known and the underlying cause, if any, such as a database or network error.
+//
+// errors.Is(err, REPLAYED_OTP) matches the Status, errors.As(err, &status) extracts it, and errors.Is and errors.As
+// also match the cause. See StatusOf().
+type ValidationError struct {
+	Status Status
+	// YubikeyID the public ID of the Yubikey, the first TokenIDLen characters of the OTP
+	YubikeyID string
+	// Err the cause of the Status, if any
+	Err error
+}
+
+// NewValidationError creates the error of the Yubikey `ykid` with the status and cause, either of which may be empty
+func NewValidationError(status Status, ykid string, cause error) *ValidationError {
+	return &ValidationError{Status: status, YubikeyID: ykid, Err: cause}
+}
+
+// Error formats the status, Yubikey ID and cause. Ex. "UNREGISTERED_USER: yubikey cccccccccccb: record not found"
+func (e *ValidationError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Status.String())
+	if e.YubikeyID != "" {
+		sb.WriteString(": yubikey ")
+		sb.WriteString(e.YubikeyID)
+	}
+	if e.Err != nil {
+		sb.WriteString(": ")
+		sb.WriteString(e.Err.Error())
+	}
+	return sb.String()
+}
+
+// Unwrap returns the cause
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches a Status target with the Status of the error
+func (e *ValidationError) Is(target error) bool {
+	s, ok := target.(Status)
+	return ok && s == e.Status
+}
+
+// As sets a *Status target to the Status of the error
+func (e *ValidationError) As(target interface{}) bool {
+	s, ok := target.(*Status)
+	if ok {
+		*s = e.Status
+	}
+	return ok
+}
+
+// StatusOf returns the Status of an error; OK for nil, the Status of a ValidationError or a Status in the chain of the
+// error, else BACKEND_ERROR
+func StatusOf(err error) Status {
+	if err == nil {
+		return OK
+	}
+	var status Status
+	if errors.As(err, &status) {
+		return status
+	}
+	return BACKEND_ERROR
+}
+
+// WrapValidationError returns an error as a *ValidationError of the Yubikey ID. A ValidationError is returned as it is,
+// with the Yubikey ID set if it had none. A bare Status becomes the Status of the error. Any other error is the cause,
+// with the Status of StatusOf(). Nil stays nil.
+func WrapValidationError(err error, ykid string) error {
+	if err == nil {
+		return nil
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		if verr.YubikeyID == "" {
+			verr.YubikeyID = ykid
+		}
+		return err
+	}
+	if s, ok := err.(Status); ok {
+		return NewValidationError(s, ykid, nil)
+	}
+	return NewValidationError(StatusOf(err), ykid, err)
+}
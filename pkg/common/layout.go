@@ -0,0 +1,111 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ModHex the alphabet of Yubikey OTPs. A Yubikey types the keys of these characters on a US QWERTY keyboard.
+const ModHex = "cbdefghijklnrtuv"
+
+// Layout a keyboard layout of the host. The Yubikey types scan codes, so the OTP arrives as the characters of the
+// ModHex keys in the layout of the host.
+//
+// The ModHex keys type the same letters on AZERTY and QWERTZ as on QWERTY, so that LayoutQWERTY covers them.
+type Layout struct {
+	Name string
+	// Keys the characters of the ModHex keys in the layout, in the order of ModHex
+	Keys string
+}
+
+// nolint
+var (
+	LayoutQWERTY  = Layout{Name: "qwerty", Keys: ModHex}
+	LayoutDvorak  = Layout{Name: "dvorak", Keys: "jxe.uidchtnbpygk"}
+	LayoutColemak = Layout{Name: "colemak", Keys: "cbsftdhuneikpglv"}
+)
+
+// Layouts the layouts NormalizeOTP() detects, in the order they are tried
+var Layouts = []Layout{LayoutQWERTY, LayoutDvorak, LayoutColemak}
+
+// ToModHex translates the characters typed in the layout to ModHex. Characters that are not of the layout are kept as
+// they are and false is returned.
+func (l Layout) ToModHex(s string) (string, bool) {
+	ok := true
+	b := []byte(s)
+	for i := range b {
+		if k := strings.IndexByte(l.Keys, b[i]); k >= 0 {
+			b[i] = ModHex[k]
+		} else {
+			ok = false
+		}
+	}
+	return string(b), ok
+}
+
+// FromModHex the characters that the ModHex string types in the layout
+func (l Layout) FromModHex(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		b[i] = s[i]
+		if k := strings.IndexByte(ModHex, s[i]); k >= 0 {
+			b[i] = l.Keys[k]
+		}
+	}
+	return string(b)
+}
+
+// IsModHex are all the characters of the string ModHex?
+func IsModHex(s string) bool {
+	_, ok := LayoutQWERTY.ToModHex(s)
+	return ok
+}
+
+// NormalizeOTP translates an OTP typed on a host of any of the Layouts to ModHex. Upper case, as typed with caps
+// lock, is folded to lower case and surrounding white space is removed. The layout is the first whose characters are
+// all of the passcode, the last TokenOTPLen characters; a passcode of ModHex characters is taken as it is. Characters
+// of the public ID that are not of the layout are kept, for IDs registered in another alphabet. Returns BAD_OTP if the
+// passcode is not of any layout.
+//
+// A passcode may be of the characters of several layouts, ex. a Colemak passcode of only QWERTY ModHex characters.
+// Validators that can tell whether the OTP decrypts try each of OTPCandidates() instead.
+func NormalizeOTP(otp string) (string, error) {
+	candidates, err := OTPCandidates(otp)
+	if err != nil {
+		return otp, err
+	}
+	return candidates[0], nil
+}
+
+// OTPCandidates the translations of the OTP to ModHex of each of the Layouts whose characters are all of the passcode,
+// in the order of Layouts and without duplicates. The first is that of NormalizeOTP(). Since only one of them decrypts,
+// a validator that finds one does not, ex. a CRC_FAILURE, tries the next.
+func OTPCandidates(otp string) ([]string, error) {
+	otp = strings.ToLower(strings.TrimSpace(otp))
+	passcode := otp
+	if len(passcode) > TokenOTPLen {
+		passcode = passcode[len(passcode)-TokenOTPLen:]
+	}
+	var candidates []string
+	for _, l := range Layouts {
+		if _, ok := l.ToModHex(passcode); !ok {
+			continue
+		}
+		s, _ := l.ToModHex(otp)
+		dup := false
+		for _, c := range candidates {
+			dup = dup || c == s
+		}
+		if !dup {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, NewValidationError(BAD_OTP, "", fmt.Errorf("OTP is not ModHex in a known keyboard layout"))
+	}
+	return candidates, nil
+}
+
+// IsLayoutMismatch is the error of validating an OTP translated from the wrong layout? The OTP then does not decrypt,
+// or its public ID is of another Yubikey. See OTPCandidates().
+var IsLayoutMismatch = NextIf(CRC_FAILURE, BAD_OTP, UNREGISTERED_USER)
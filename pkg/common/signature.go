@@ -0,0 +1,34 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // nolint:gosec // HMAC-SHA1 is mandated by the Validation Protocol
+	"sort"
+)
+
+// Signature returns the HMAC-SHA1 of request or response parameters as defined by the Yubico Validation Protocol.
+// The key=value pairs are sorted by key and joined with '&'. The "h" parameter, which holds the signature, is excluded.
+//
+// See https://developers.yubico.com/yubikey-val/Validation_Protocol_V2.0.html
+func Signature(m map[string]string, key []byte) []byte {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := hmac.New(sha1.New, key)
+	var ampersand []byte
+	for _, k := range keys {
+		if k == "h" {
+			continue
+		}
+		_, _ = h.Write(ampersand)
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{'='})
+		_, _ = h.Write([]byte(m[k]))
+		ampersand = []byte{'&'}
+	}
+
+	return h.Sum(nil)
+}
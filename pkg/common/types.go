@@ -26,8 +26,10 @@ const (
 	REPLAYED_REQUEST             // Server has seen the OTP/Nonce combination before
 
 	CRC_FAILURE
-	EMPTY_YUBI_TOKEN  // provided OTP is empty
-	UNREGISTERED_USER // Yubikey not registered in database
+	EMPTY_YUBI_TOKEN    // provided OTP is empty
+	UNREGISTERED_USER   // Yubikey not registered in database
+	PRIVATE_ID_MISMATCH // the private ID of the decrypted OTP is not the one registered for the Yubikey
+	DELAYED_OTP         // the OTP token clock disagrees with the server clock; it may have been phished and replayed
 )
 
 // nolint
@@ -47,6 +49,8 @@ var statusStrings = []string{
 	"CRC_FAILURE",
 	"EMPTY_YUBI_TOKEN",
 	"UNREGISTERED_USER",
+	"PRIVATE_ID_MISMATCH",
+	"DELAYED_OTP",
 }
 
 func (s Status) Error() string {
@@ -76,6 +80,13 @@ func (s Status) IsError() bool {
 	return s == BACKEND_ERROR || s == BAD_OTP || s == BAD_SIGNATURE || s == NO_SUCH_CLIENT || s == MISSING_PARAMETER
 }
 
+// IsRetryable the OTP was rejected in a way the user may correct by trying again with a new OTP.
+// See IsTransient() for the statuses where the same request may be sent again.
 func (s Status) IsRetryable() bool {
 	return s == BAD_OTP || s == NO_SUCH_CLIENT || s == MISSING_PARAMETER
 }
+
+// IsTransient the status reports a temporary server-side condition rather than an answer about the OTP
+func (s Status) IsTransient() bool {
+	return s == BACKEND_ERROR || s == NOT_ENOUGH_ANSWERS
+}
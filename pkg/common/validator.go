@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"errors"
+)
+
+// Validator validates Yubikey OTPs with a backend, so that services are written once for YubiCloud, self-hosted or
+// both. See yubico.YubiClient.Validator(), selfhosted.YubiAuth.Validator() and NewChain().
+type Validator interface {
+	// Validate validates the full OTP (public key and passcode). The Result is returned with its Status and YubikeyID
+	// set even when the OTP does not validate, with a *ValidationError.
+	Validate(ctx context.Context, otp string) (Result, error)
+}
+
+// Result the outcome of validating an OTP with a Validator
+type Result struct {
+	// YubikeyID the public ID of the Yubikey, the first TokenIDLen characters of the OTP
+	YubikeyID string
+	// Counter the usage counter of the Yubikey when the key was pressed
+	Counter uint
+	// Session the session usage counter of the Yubikey when the key was pressed
+	Session uint
+	// Timestamp the internal 8Hz timestamp of the Yubikey when the key was pressed
+	Timestamp uint
+	// Status OK when the OTP validated
+	Status Status
+	// Backend the name of the backend that answered. Ex. "yubicloud" or "selfhosted"
+	Backend string
+}
+
+// NewResult the Result of a backend for the OTP with the Status of the error, OK when it is nil. See StatusOf().
+func NewResult(backend string, otp string, err error) Result {
+	r := Result{YubikeyID: otp, Status: StatusOf(err), Backend: backend}
+	if len(r.YubikeyID) > TokenIDLen {
+		r.YubikeyID = r.YubikeyID[:TokenIDLen]
+	}
+	return r
+}
+
+// ChainPolicy decides whether a Chain tries its next backend after one rejected an OTP with the error
+type ChainPolicy func(err error) bool
+
+// NextIf a ChainPolicy that tries the next backend when the error is of one of the statuses
+func NextIf(statuses ...Status) ChainPolicy {
+	return func(err error) bool {
+		s := StatusOf(err)
+		for _, st := range statuses {
+			if s == st {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DefaultChainPolicy tries the next backend when the Yubikey is not registered with a backend or the backend is
+// unavailable. An OTP that a backend rejected, such as a REPLAYED_OTP, is never tried with another.
+var DefaultChainPolicy = NextIf(UNREGISTERED_USER, BACKEND_ERROR, NOT_ENOUGH_ANSWERS)
+
+// Chain a Validator that tries its backends in order until one validates the OTP or the policy stops it
+type Chain struct {
+	policy   ChainPolicy
+	backends []Validator
+}
+
+// NewChain creates a Validator over the backends. A nil policy is DefaultChainPolicy.
+func NewChain(policy ChainPolicy, backends ...Validator) *Chain {
+	if policy == nil {
+		policy = DefaultChainPolicy
+	}
+	return &Chain{policy: policy, backends: backends}
+}
+
+// Validate validates the OTP with each backend in turn. Returns the Result of the first backend that validates it,
+// else the Result and error of the last backend tried.
+func (ch *Chain) Validate(ctx context.Context, otp string) (Result, error) {
+	if len(ch.backends) == 0 {
+		res := NewResult("", otp, BACKEND_ERROR)
+		return res, NewValidationError(res.Status, res.YubikeyID, errors.New("no validation backends"))
+	}
+	var (
+		res Result
+		err error
+	)
+	for _, v := range ch.backends {
+		if res, err = v.Validate(ctx, otp); err == nil || !ch.policy(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return res, err
+}
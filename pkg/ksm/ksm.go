@@ -0,0 +1,191 @@
+package ksm
+
+/*** A Key Storage Module (KSM) in the style of Yubico's YKKSM. The KSM is a separate service that holds the AES keys of
+the Yubikeys and only answers requests to decrypt an OTP. The validation service keeps the counters and calls the KSM
+through the selfhosted.KSM interface, so that a compromised validation database does not leak AES keys.
+See https://developers.yubico.com/yubikey-ksm/
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+	"github.com/dsggregory/yubiv/pkg/selfhosted"
+	"gopkg.in/yaml.v2"
+)
+
+// DecryptPath the path of the decrypt endpoint of a YKKSM server
+const DecryptPath = "/wsapi/decrypt"
+
+// Key the secrets of a Yubikey held by the KSM
+type Key struct {
+	// Public the Yubikey ID
+	Public string
+	// AESKey the 16-byte AES key of the Yubikey slot
+	AESKey []byte
+	// PrivateID the optional 6-byte private identity. When set, OTPs carrying a different one are refused.
+	PrivateID []byte
+}
+
+// KeyStore the storage of the KSM. Key returns common.UNREGISTERED_USER when the Yubikey is unknown.
+type KeyStore interface {
+	Key(ctx context.Context, public string) (*Key, error)
+}
+
+// MapKeyStore an in-memory KeyStore safe for concurrent use
+type MapKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]Key
+}
+
+// NewMapKeyStore creates an empty key store
+func NewMapKeyStore() *MapKeyStore {
+	return &MapKeyStore{keys: make(map[string]Key)}
+}
+
+// Add stores the key, replacing any key with the same Public
+func (m *MapKeyStore) Add(key Key) error {
+	if len(key.AESKey) != selfhosted.AesSize {
+		return fmt.Errorf("AES key of %s must be %d bytes", key.Public, selfhosted.AesSize)
+	}
+	if len(key.PrivateID) != 0 && len(key.PrivateID) != selfhosted.UidSize {
+		return fmt.Errorf("private ID of %s must be %d bytes", key.Public, selfhosted.UidSize)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key.Public] = key
+	return nil
+}
+
+// Key returns the key of the Yubikey `public`
+func (m *MapKeyStore) Key(_ context.Context, public string) (*Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.keys[public]
+	if !ok {
+		return nil, common.UNREGISTERED_USER
+	}
+	return &k, nil
+}
+
+// LoadKeyFile adds the keys of a YAML file of the form:
+//
+//	keys:
+//	  - public: ccccccjddvfl
+//	    aes_key: 9a781c53532db8eb0c51ed87188cae98
+//	    private_id: 8d7f3ab2c901
+//
+// where aes_key and the optional private_id are hex-encoded.
+func (m *MapKeyStore) LoadKeyFile(path string) error {
+	type keyRec struct {
+		Public    string `yaml:"public"`
+		AESKey    string `yaml:"aes_key"`
+		PrivateID string `yaml:"private_id"`
+	}
+	var kf struct {
+		Keys []keyRec `yaml:"keys"`
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fp.Close() }()
+	if err = yaml.NewDecoder(fp).Decode(&kf); err != nil {
+		return err
+	}
+	for _, r := range kf.Keys {
+		aesKey, err := hex.DecodeString(strings.TrimSpace(r.AESKey))
+		if err != nil {
+			return fmt.Errorf("%w; aes_key of %s", err, r.Public)
+		}
+		privID, err := hex.DecodeString(strings.TrimSpace(r.PrivateID))
+		if err != nil {
+			return fmt.Errorf("%w; private_id of %s", err, r.Public)
+		}
+		if err = m.Add(Key{Public: r.Public, AESKey: aesKey, PrivateID: privID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Local a selfhosted.KSM that decrypts in-process with a KeyStore. Use Client to reach a KSM service instead.
+type Local struct {
+	Keys KeyStore
+}
+
+// Decrypt deciphers the full OTP with the key of its Yubikey
+func (l Local) Decrypt(ctx context.Context, otp string) (*selfhosted.Token, error) {
+	pub, passcode, err := selfhosted.ParseToken(otp)
+	if err != nil {
+		return nil, common.WrapValidationError(err, yubikeyID(otp))
+	}
+	token, err := l.decrypt(ctx, string(pub), passcode)
+	return token, common.WrapValidationError(err, string(pub))
+}
+
+// decrypt deciphers the passcode of the OTP with the key of the Yubikey `pub`
+func (l Local) decrypt(ctx context.Context, pub string, passcode []byte) (*selfhosted.Token, error) {
+	key, err := l.Keys.Key(ctx, pub)
+	if err != nil {
+		return nil, err
+	}
+	token, err := selfhosted.DecryptOTP(passcode, key.AESKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key.PrivateID) > 0 && subtle.ConstantTimeCompare(key.PrivateID, token.Uid[:]) != 1 {
+		// as YKKSM, do not tell the caller which part of the OTP was wrong
+		return nil, common.CRC_FAILURE
+	}
+	return token, nil
+}
+
+// formatToken formats a decrypted token as the decrypt endpoint responds
+func formatToken(t *selfhosted.Token) string {
+	return fmt.Sprintf("OK counter=%04x low=%04x high=%02x use=%02x uid=%x", t.Ctr, t.Tstpl, t.Tstph, t.Use, t.Uid[:])
+}
+
+// parseToken parses the response of the decrypt endpoint
+func parseToken(resp []byte) (*selfhosted.Token, error) {
+	resp = bytes.TrimSpace(resp)
+	if !bytes.HasPrefix(resp, []byte("OK ")) {
+		return nil, fmt.Errorf("unexpected KSM response %q", resp)
+	}
+	t := &selfhosted.Token{}
+	for _, field := range strings.Fields(string(resp[3:])) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch kv[0] {
+		case "counter":
+			_, err = fmt.Sscanf(kv[1], "%x", &t.Ctr)
+		case "low":
+			_, err = fmt.Sscanf(kv[1], "%x", &t.Tstpl)
+		case "high":
+			_, err = fmt.Sscanf(kv[1], "%x", &t.Tstph)
+		case "use":
+			_, err = fmt.Sscanf(kv[1], "%x", &t.Use)
+		case "uid":
+			var uid []byte
+			if uid, err = hex.DecodeString(kv[1]); err == nil && len(uid) != selfhosted.UidSize {
+				err = fmt.Errorf("uid is %d bytes", len(uid))
+			}
+			copy(t.Uid[:], uid)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w; KSM response field %s", err, kv[0])
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,111 @@
+package ksm
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+	"github.com/dsggregory/yubiv/pkg/selfhosted"
+	yubitest "github.com/dsggregory/yubiv/pkg/test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&ksmSuite{})
+
+type ksmSuite struct {
+	keys *MapKeyStore
+}
+
+func (s *ksmSuite) SetUpTest(c *C) {
+	s.keys = NewMapKeyStore()
+	for _, tt := range yubitest.TestTokens {
+		aesKey, err := hex.DecodeString(tt.Secret)
+		c.Assert(err, IsNil)
+		c.Assert(s.keys.Add(Key{Public: tt.Pub, AESKey: aesKey}), IsNil)
+	}
+}
+
+func (s *ksmSuite) TestDecrypt(c *C) {
+	ts := httptest.NewServer(NewHandler(s.keys))
+	defer ts.Close()
+	client := NewClient(ts.URL + DecryptPath)
+	local := Local{Keys: s.keys}
+	ctx := context.Background()
+
+	for i := range yubitest.TestTokens[0].OTPs {
+		otp := yubitest.TestTokens[0].Token(i)
+		exp, err := local.Decrypt(ctx, otp)
+		c.Assert(err, IsNil)
+		c.Assert(exp.Use, Equals, uint8(i+1))
+
+		tok, err := client.Decrypt(ctx, otp)
+		c.Assert(err, IsNil)
+		c.Assert(tok.Ctr, Equals, exp.Ctr)
+		c.Assert(tok.Use, Equals, exp.Use)
+		c.Assert(tok.Tstpl, Equals, exp.Tstpl)
+		c.Assert(tok.Tstph, Equals, exp.Tstph)
+		c.Assert(tok.Uid, Equals, exp.Uid)
+	}
+
+	_, err := client.Decrypt(ctx, "ccccccjccccccccccccccccccccccccccccccccccccc")
+	c.Assert(err, yubitest.ErrorIs, common.UNREGISTERED_USER)
+	_, err = client.Decrypt(ctx, yubitest.TestTokens[0].Pub+yubitest.TestTokens[1].OTPs[0])
+	c.Assert(err, yubitest.ErrorIs, common.CRC_FAILURE)
+	_, err = client.Decrypt(ctx, "short")
+	c.Assert(err, yubitest.ErrorIs, common.BAD_OTP)
+}
+
+func (s *ksmSuite) TestPrivateID(c *C) {
+	ctx := context.Background()
+	tt := yubitest.TestTokens[0]
+	tok, err := Local{Keys: s.keys}.Decrypt(ctx, tt.Token(0))
+	c.Assert(err, IsNil)
+
+	key, err := s.keys.Key(ctx, tt.Pub)
+	c.Assert(err, IsNil)
+	key.PrivateID = tok.Uid[:]
+	c.Assert(s.keys.Add(*key), IsNil)
+	_, err = Local{Keys: s.keys}.Decrypt(ctx, tt.Token(1))
+	c.Assert(err, IsNil)
+
+	key.PrivateID = []byte{1, 2, 3, 4, 5, 6}
+	c.Assert(s.keys.Add(*key), IsNil)
+	_, err = Local{Keys: s.keys}.Decrypt(ctx, tt.Token(1))
+	c.Assert(err, yubitest.ErrorIs, common.CRC_FAILURE)
+}
+
+func (s *ksmSuite) TestLoadKeyFile(c *C) {
+	tt := yubitest.TestTokens[0]
+	path := filepath.Join(c.MkDir(), "keys.yaml")
+	data := "keys:\n  - public: " + tt.Pub + "\n    aes_key: " + tt.Secret + "\n"
+	c.Assert(os.WriteFile(path, []byte(data), 0600), IsNil)
+
+	keys := NewMapKeyStore()
+	c.Assert(keys.LoadKeyFile(path), IsNil)
+	tok, err := Local{Keys: keys}.Decrypt(context.Background(), tt.Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(tok.Use, Equals, uint8(1))
+
+	c.Assert(os.WriteFile(path, []byte("keys:\n  - public: x\n    aes_key: abcd\n"), 0600), IsNil)
+	c.Assert(keys.LoadKeyFile(path), NotNil)
+}
+
+func (s *ksmSuite) TestYubiAuth(c *C) {
+	ts := httptest.NewServer(NewHandler(s.keys))
+	defer ts.Close()
+	y, err := selfhosted.NewYubiAuth(selfhosted.WithKSM(NewClient(ts.URL + DecryptPath)))
+	c.Assert(err, IsNil)
+
+	y.SetToken(yubitest.TestTokens[2].Token(0))
+	_, device, err := y.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(device.Session, Equals, int64(1))
+}
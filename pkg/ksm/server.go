@@ -0,0 +1,128 @@
+package ksm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+	"github.com/dsggregory/yubiv/pkg/selfhosted"
+	log "github.com/sirupsen/logrus"
+)
+
+// The error responses of the decrypt endpoint, as YKKSM sends them
+const (
+	errInvalidOTP = "ERR Invalid OTP format"
+	errUnknownKey = "ERR Unknown yubikey"
+	errCorruptOTP = "ERR Corrupt OTP"
+	errDatabase   = "ERR Database error"
+)
+
+// Handler an http.Handler that serves the YKKSM decrypt endpoint. Mount it at DecryptPath.
+//
+// A request `?otp=<otp>` is answered with `OK counter=XXXX low=XXXX high=XX use=XX uid=XXXXXXXXXXXX`, all values in hex,
+// or with a line starting with `ERR`.
+type Handler struct {
+	ksm Local
+}
+
+// NewHandler creates a decrypt endpoint for the keys in `keys`
+func NewHandler(keys KeyStore) *Handler {
+	return &Handler{ksm: Local{Keys: keys}}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	otp := strings.TrimSpace(r.URL.Query().Get("otp"))
+	token, err := h.ksm.Decrypt(r.Context(), otp)
+	if err != nil {
+		var status common.Status
+		msg := errDatabase
+		if errors.As(err, &status) {
+			switch status {
+			case common.BAD_OTP:
+				msg = errInvalidOTP
+			case common.UNREGISTERED_USER:
+				msg = errUnknownKey
+			case common.CRC_FAILURE:
+				msg = errCorruptOTP
+			}
+		}
+		if msg == errDatabase {
+			log.WithError(err).WithField("otp", otp).Error("unable to decrypt OTP")
+		}
+		_, _ = fmt.Fprintln(w, msg)
+		return
+	}
+	_, _ = fmt.Fprintln(w, formatToken(token))
+}
+
+// Client a selfhosted.KSM that calls a KSM service over HTTP. It works with this package's Handler and with YKKSM,
+// although YKKSM does not report the private ID of the token.
+type Client struct {
+	// URL the decrypt endpoint, ex. "https://ksm.example.com/wsapi/decrypt"
+	URL string
+	// HTTPClient the client used for requests. Default is http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client of the KSM decrypt endpoint at `url`
+func NewClient(url string) *Client {
+	return &Client{URL: url, HTTPClient: http.DefaultClient}
+}
+
+// Decrypt asks the KSM to decipher the full OTP
+func (c *Client) Decrypt(ctx context.Context, otp string) (*selfhosted.Token, error) {
+	token, err := c.decrypt(ctx, otp)
+	return token, common.WrapValidationError(err, yubikeyID(otp))
+}
+
+// yubikeyID returns the Yubikey ID of the OTP, which precedes its passcode
+func yubikeyID(otp string) string {
+	if len(otp) <= selfhosted.OtpSize {
+		return ""
+	}
+	return otp[:len(otp)-selfhosted.OtpSize]
+}
+
+// decrypt does the work of Decrypt()
+func (c *Client) decrypt(ctx context.Context, otp string) (*selfhosted.Token, error) {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"?"+url.Values{"otp": {otp}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KSM responded %s", resp.Status)
+	}
+
+	body = bytes.TrimSpace(body)
+	switch {
+	case bytes.HasPrefix(body, []byte(errInvalidOTP)):
+		return nil, common.BAD_OTP
+	case bytes.HasPrefix(body, []byte(errUnknownKey)):
+		return nil, common.UNREGISTERED_USER
+	case bytes.HasPrefix(body, []byte(errCorruptOTP)):
+		return nil, common.CRC_FAILURE
+	case bytes.HasPrefix(body, []byte("ERR")):
+		return nil, fmt.Errorf("KSM %s", body)
+	}
+	return parseToken(body)
+}
@@ -0,0 +1,163 @@
+package otp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ClockRate the frequency of the token clock, which starts at a random value when the Yubikey is powered up
+const ClockRate = 8 // Hz
+
+// maxCounter the largest usage counter; the Yubikey stops generating OTPs after it
+const maxCounter = 0x7fff
+
+// Generator a soft Yubikey that generates OTPs, as ykgenerate does, for fixtures and tests. Each OTP has the next
+// session use of the power-up session; the usage counter increments with each power-up or when the session use wraps.
+type Generator struct {
+	public string
+	uid    [UIDSize]byte
+	key    []byte
+	// now the clock of the token timestamp; time.Now when nil
+	now func() time.Time
+	// rand the source of the random fields
+	rand io.Reader
+
+	mu      sync.Mutex
+	ctr     uint16
+	use     uint8
+	tsStart uint32
+	powerUp time.Time
+	started bool
+}
+
+// WithCounter an optional arg to NewGenerator that specifies the usage counter of the first power-up session. Default
+// is 1.
+func WithCounter(ctr uint16) func(g *Generator) {
+	return func(g *Generator) {
+		if ctr > maxCounter {
+			panic(fmt.Errorf("usage counter %d is more than %d", ctr, maxCounter))
+		}
+		g.ctr = ctr
+	}
+}
+
+// WithClock an optional arg to NewGenerator that specifies the clock of the token timestamp. Default is time.Now.
+func WithClock(now func() time.Time) func(g *Generator) {
+	return func(g *Generator) {
+		g.now = now
+	}
+}
+
+// WithRandom an optional arg to NewGenerator that specifies the source of the random start of the token clock and of
+// the random field of each OTP, so that fixtures can be reproduced. Default is crypto/rand.
+func WithRandom(r io.Reader) func(g *Generator) {
+	return func(g *Generator) {
+		g.rand = r
+	}
+}
+
+// NewGenerator creates a soft Yubikey with the public ID, usually 12 ModHex characters, the private UID and the 16-byte
+// AES key. Options may be one of the With*() functions. Ex. WithCounter().
+func NewGenerator(public string, uid []byte, key []byte, options ...func(g *Generator)) (rg *Generator, rerr error) {
+	if len(uid) != UIDSize {
+		return nil, fmt.Errorf("private UID must be %d bytes", UIDSize)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("AES key must be %d bytes", KeySize)
+	}
+	g := &Generator{public: public, key: append([]byte(nil), key...), ctr: 1, now: time.Now, rand: rand.Reader}
+	copy(g.uid[:], uid)
+
+	// catch panic() from optional arg funcs
+	defer func() {
+		if err := recover(); err != nil {
+			rerr = err.(error)
+		}
+	}()
+
+	for _, o := range options {
+		o(g)
+	}
+	return g, nil
+}
+
+// random the next random 16 bits
+func (g *Generator) random() (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(g.rand, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b[:]), nil
+}
+
+// PowerUp starts a new session, as when the Yubikey is plugged in again. The usage counter increments, the session use
+// restarts at 0 and the token clock at a random value.
+func (g *Generator) PowerUp() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.started {
+		if g.ctr >= maxCounter {
+			return fmt.Errorf("usage counter is exhausted")
+		}
+		g.ctr++
+	}
+	return g.powerUpLocked()
+}
+
+// powerUpLocked starts the session of the current usage counter
+func (g *Generator) powerUpLocked() error {
+	r, err := g.random()
+	if err != nil {
+		return err
+	}
+	g.started = true
+	g.use = 0
+	// the Yubikey starts its clock at a random value in the low half of its range so that it does not soon wrap
+	g.tsStart = uint32(r) << 7
+	g.powerUp = g.now()
+	return nil
+}
+
+// Next the next token of the session, in the order of the Yubikey. The first call powers up the Yubikey.
+func (g *Generator) Next() (*Token, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.started {
+		if err := g.powerUpLocked(); err != nil {
+			return nil, err
+		}
+	}
+	rnd, err := g.random()
+	if err != nil {
+		return nil, err
+	}
+	t := &Token{Uid: g.uid, Ctr: g.ctr, Use: g.use, Rnd: rnd}
+	t.SetTimestamp(g.tsStart + uint32(g.now().Sub(g.powerUp)*ClockRate/time.Second))
+
+	if g.use == 0xff {
+		// the session use wraps; the Yubikey counts another use
+		if g.ctr >= maxCounter {
+			return nil, fmt.Errorf("usage counter is exhausted")
+		}
+		g.ctr++
+	}
+	g.use++
+	return t, nil
+}
+
+// OTP the next full OTP, public ID and passcode, as the Yubikey types it when touched
+func (g *Generator) OTP() (string, error) {
+	t, err := g.Next()
+	if err != nil {
+		return "", err
+	}
+	passcode, err := Encrypt(t, g.key)
+	if err != nil {
+		return "", err
+	}
+	return g.public + passcode, nil
+}
@@ -0,0 +1,165 @@
+// Package otp encodes and decodes Yubikey OTPs: ModHex, the Token fields, and their AES-128 encryption. See
+// https://developers.yubico.com/OTP/OTPs_Explained.html
+package otp
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+)
+
+const (
+	UIDSize     = 6  // the private ID of the Yubikey
+	KeySize     = 16 // the AES-128 key of the Yubikey
+	TokenSize   = 16 // the binary Token, one AES block
+	PasscodeLen = common.TokenOTPLen
+	// CRCOkResidue the CRC16 of a Token, checksum included, that is not corrupt
+	CRCOkResidue = 0xf0b8
+)
+
+// Token Yubikey token structure. See https://developers.yubico.com/OTP/OTPs_Explained.html
+type Token struct {
+	// Uid Private secret ID
+	Uid [UIDSize]byte // nolint
+	// Ctr Usage counter
+	Ctr uint16
+	// Tstpl timestamp
+	Tstpl uint16
+	// Tstph timestamp hour
+	Tstph uint8
+	// Use Session usage counter
+	Use uint8
+	// Rnd Random number
+	Rnd uint16
+	// Crc checksum of token
+	Crc uint16
+}
+
+// Timestamp the 24-bit value of the token clock when the OTP was generated, at 8Hz from the power-up of the Yubikey
+func (t Token) Timestamp() uint32 {
+	return uint32(t.Tstph)<<16 | uint32(t.Tstpl)
+}
+
+// SetTimestamp sets the token clock from the low 24 bits of `ts`
+func (t *Token) SetTimestamp(ts uint32) {
+	t.Tstpl = uint16(ts)
+	t.Tstph = uint8(ts >> 16)
+}
+
+// MarshalBinary the 16 bytes of the token with its checksum computed over the others. Crc is set.
+func (t *Token) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, TokenSize)
+	copy(buf, t.Uid[:])
+	binary.LittleEndian.PutUint16(buf[6:], t.Ctr)
+	binary.LittleEndian.PutUint16(buf[8:], t.Tstpl)
+	buf[10] = t.Tstph
+	buf[11] = t.Use
+	binary.LittleEndian.PutUint16(buf[12:], t.Rnd)
+	t.Crc = ^CRC16(buf[:14])
+	binary.LittleEndian.PutUint16(buf[14:], t.Crc)
+	return buf, nil
+}
+
+// UnmarshalBinary parses the 16 bytes of a token. Returns common.CRC_FAILURE if the checksum does not match.
+func (t *Token) UnmarshalBinary(buf []byte) error {
+	if len(buf) != TokenSize || CRC16(buf) != CRCOkResidue {
+		return common.CRC_FAILURE
+	}
+
+	copy(t.Uid[:], buf[:6])
+
+	t.Ctr = binary.LittleEndian.Uint16(buf[6:])
+	t.Tstpl = binary.LittleEndian.Uint16(buf[8:])
+
+	t.Tstph = buf[10]
+	t.Use = buf[11]
+
+	t.Rnd = binary.LittleEndian.Uint16(buf[12:])
+	t.Crc = binary.LittleEndian.Uint16(buf[14:])
+
+	return nil
+}
+
+// CRC16 the ISO 13239 checksum of a Yubikey token
+func CRC16(buf []byte) uint16 {
+	mCRC := uint16(0xffff)
+	for _, val := range buf {
+		mCRC ^= uint16(val & 0xff)
+		for i := 0; i < 8; i++ {
+			j := mCRC & 1
+			mCRC >>= 1
+			if j > 0 {
+				mCRC ^= 0x8408
+			}
+		}
+	}
+
+	return mCRC
+}
+
+// ModHexEncode encodes bytes as ModHex, two characters per byte
+func ModHexEncode(src []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(src) * 2)
+	for _, b := range src {
+		sb.WriteByte(common.ModHex[b>>4])
+		sb.WriteByte(common.ModHex[b&0xf])
+	}
+	return sb.String()
+}
+
+// ModHexDecode decodes a ModHex string. Returns common.BAD_OTP if it is of odd length or a character is not ModHex.
+// See common.NormalizeOTP() for OTPs typed in other keyboard layouts.
+func ModHexDecode(src string) ([]byte, error) {
+	if len(src)%2 != 0 {
+		return nil, common.BAD_OTP
+	}
+	dst := make([]byte, len(src)/2)
+	for i := 0; i < len(src); i += 2 {
+		hi := strings.IndexByte(common.ModHex, src[i])
+		lo := strings.IndexByte(common.ModHex, src[i+1])
+		if hi < 0 || lo < 0 {
+			return nil, common.BAD_OTP
+		}
+		dst[i/2] = byte(hi<<4 | lo)
+	}
+	return dst, nil
+}
+
+// Encrypt the ModHex passcode of the token, without the public ID, encrypted with the 16-byte AES key of the Yubikey.
+// Crc is set.
+func Encrypt(t *Token, key []byte) (string, error) {
+	if len(key) != KeySize {
+		return "", fmt.Errorf("AES key must be %d bytes", KeySize)
+	}
+	buf, _ := t.MarshalBinary()
+	cipher, _ := aes.NewCipher(key)
+	cipher.Encrypt(buf, buf)
+	return ModHexEncode(buf), nil
+}
+
+// Decrypt deciphers the 32-character ModHex `passcode`, without the public ID, with the 16-byte AES key of the Yubikey.
+// It does not check the counters of the token.
+func Decrypt(passcode string, key []byte) (*Token, error) {
+	if len(passcode) != PasscodeLen {
+		return nil, common.BAD_OTP
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("AES key must be %d bytes", KeySize)
+	}
+	buf, err := ModHexDecode(passcode)
+	if err != nil {
+		return nil, err
+	}
+	cipher, _ := aes.NewCipher(key)
+	cipher.Decrypt(buf, buf)
+
+	var t Token
+	if err = t.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,114 @@
+package otp
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+	yubitest "github.com/dsggregory/yubiv/pkg/test"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&otpSuite{})
+
+type otpSuite struct {
+}
+
+func (s *otpSuite) TestModHex(c *C) {
+	b := []byte{0x00, 0x01, 0x7f, 0xff}
+	c.Assert(ModHexEncode(b), Equals, "cccbivvv")
+	d, err := ModHexDecode("cccbivvv")
+	c.Assert(err, IsNil)
+	c.Assert(d, DeepEquals, b)
+
+	_, err = ModHexDecode("cccbijv")
+	c.Assert(err, Equals, common.BAD_OTP)
+	_, err = ModHexDecode("cccbij0v")
+	c.Assert(err, Equals, common.BAD_OTP)
+}
+
+func (s *otpSuite) TestCodec(c *C) {
+	// reproduces the OTPs of ykgenerate
+	for _, tt := range yubitest.TestTokens {
+		key, _ := hex.DecodeString(tt.Secret)
+		for i, passcode := range tt.OTPs {
+			t, err := Decrypt(passcode, key)
+			c.Assert(err, IsNil)
+			c.Assert(t.Use, Equals, uint8(i+1))
+			enc, err := Encrypt(t, key)
+			c.Assert(err, IsNil)
+			c.Assert(enc, Equals, passcode)
+		}
+	}
+
+	t := Token{Uid: [UIDSize]byte{1, 2, 3, 4, 5, 6}, Ctr: 7, Use: 8, Rnd: 9}
+	t.SetTimestamp(0x123456)
+	c.Assert(t.Tstph, Equals, uint8(0x12))
+	c.Assert(t.Tstpl, Equals, uint16(0x3456))
+	buf, err := t.MarshalBinary()
+	c.Assert(err, IsNil)
+	c.Assert(CRC16(buf), Equals, uint16(CRCOkResidue))
+	var u Token
+	c.Assert(u.UnmarshalBinary(buf), IsNil)
+	c.Assert(u, Equals, t)
+
+	buf[0] ^= 1
+	c.Assert(u.UnmarshalBinary(buf), Equals, common.CRC_FAILURE)
+	_, err = Decrypt(yubitest.TestTokens[0].OTPs[0], make([]byte, KeySize))
+	c.Assert(err, Equals, common.CRC_FAILURE)
+	_, err = Decrypt("short", make([]byte, KeySize))
+	c.Assert(err, Equals, common.BAD_OTP)
+}
+
+func (s *otpSuite) TestGenerator(c *C) {
+	key, _ := hex.DecodeString(yubitest.TestTokens[0].Secret)
+	uid := []byte{1, 2, 3, 4, 5, 6}
+	now := time.Now()
+	g, err := NewGenerator("cccccccccccb", uid, key, WithClock(func() time.Time { return now }),
+		WithRandom(rand.New(rand.NewSource(1))))
+	c.Assert(err, IsNil)
+
+	var ts uint32
+	for i := 0; i < 3; i++ {
+		o, err := g.OTP()
+		c.Assert(err, IsNil)
+		c.Assert(o[:common.TokenIDLen], Equals, "cccccccccccb")
+		t, err := Decrypt(o[common.TokenIDLen:], key)
+		c.Assert(err, IsNil)
+		c.Assert(t.Uid[:], DeepEquals, uid)
+		c.Assert(t.Ctr, Equals, uint16(1))
+		c.Assert(t.Use, Equals, uint8(i))
+		if i == 0 {
+			ts = t.Timestamp()
+		}
+		c.Assert(t.Timestamp(), Equals, ts+uint32(i*ClockRate))
+		now = now.Add(time.Second)
+	}
+
+	c.Assert(g.PowerUp(), IsNil)
+	t, err := g.Next()
+	c.Assert(err, IsNil)
+	c.Assert(t.Ctr, Equals, uint16(2))
+	c.Assert(t.Use, Equals, uint8(0))
+
+	// the session use wraps
+	for i := 1; i < 0x100; i++ {
+		_, err = g.Next()
+		c.Assert(err, IsNil)
+	}
+	t, err = g.Next()
+	c.Assert(err, IsNil)
+	c.Assert(t.Ctr, Equals, uint16(3))
+	c.Assert(t.Use, Equals, uint8(0))
+
+	_, err = NewGenerator("cccccccccccb", uid, key[:8])
+	c.Assert(err, NotNil)
+	_, err = NewGenerator("cccccccccccb", uid, key, WithCounter(0x8000))
+	c.Assert(err, ErrorMatches, "usage counter .*")
+}
@@ -3,12 +3,18 @@
 package database
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dsggregory/yubiv/pkg/common"
 	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
 	"gopkg.in/yaml.v2"
+	"gorm.io/gorm"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,70 +22,445 @@ import (
 // MapDb implements Databaser interface.
 // This should be a real database that stores known user yubikey IDs and their secrets.
 type MapDb struct {
-	recs map[string]*model.YubiUser
+	// mu protects users, recs, clients and the last IDs
+	mu           sync.Mutex
+	users        map[uint]*model.User
+	recs         map[string]*model.Device
+	clients      map[string]*model.APIClient
+	lastUserID   uint
+	lastDeviceID uint
+}
+
+// AddUser stores a new user and returns it with its ID
+func (db *MapDb) AddUser(ctx context.Context, user model.User) (*model.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastUserID++
+	user.ID = db.lastUserID
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	user.Devices = nil
+	db.users[user.ID] = &user
+	u := user
+	return &u, nil
+}
+
+// GetUser returns a copy of the user with the ID and its devices
+func (db *MapDb) GetUser(ctx context.Context, id uint) (*model.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.users[id]
+	if r == nil || r.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	u := *r
+	for _, d := range db.sortedDevices() {
+		if d.UserID == id && !d.DeletedAt.Valid {
+			u.Devices = append(u.Devices, *d)
+		}
+	}
+	return &u, nil
+}
+
+// GetUserByEmail returns a copy of the user with the email
+func (db *MapDb) GetUserByEmail(ctx context.Context, email string) (*model.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, r := range db.sortedUsers() {
+		if r.Email == email && !r.DeletedAt.Valid {
+			u := *r
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *MapDb) GetAllUsers(ctx context.Context) ([]*model.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a := []*model.User{}
+	for _, v := range db.sortedUsers() {
+		if !v.DeletedAt.Valid {
+			u := *v
+			a = append(a, &u)
+		}
+	}
+	return a, nil
+}
+
+// sortedUsers the users ordered by ID. The caller holds mu.
+func (db *MapDb) sortedUsers() []*model.User {
+	a := make([]*model.User, 0, len(db.users))
+	for _, v := range db.users {
+		a = append(a, v)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].ID < a[j].ID })
+	return a
+}
+
+// sortedDevices the devices ordered by ID. The caller holds mu.
+func (db *MapDb) sortedDevices() []*model.Device {
+	a := make([]*model.Device, 0, len(db.recs))
+	for _, v := range db.recs {
+		a = append(a, v)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].ID < a[j].ID })
+	return a
+}
+
+// contains reports whether any of the values contains the substring, case-insensitively
+func contains(search string, values ...string) bool {
+	search = strings.ToLower(search)
+	for _, v := range values {
+		if strings.Contains(strings.ToLower(v), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// pageOf returns the indexes of the page of n results
+func pageOf(n int, offset int, limit int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := n
+	if limit > 0 && offset+limit < n {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// selectUsers the users selected by the filter, ordered by ID. The caller holds mu.
+func (db *MapDb) selectUsers(filter UserFilter) []*model.User {
+	a := []*model.User{}
+	for _, v := range db.sortedUsers() {
+		if (v.DeletedAt.Valid && !filter.IncludeRevoked) ||
+			(filter.Search != "" && !contains(filter.Search, v.Email, v.Description)) ||
+			(filter.IsEnabled != nil && v.IsEnabled != *filter.IsEnabled) ||
+			(filter.IsAdmin != nil && v.IsAdmin != *filter.IsAdmin) {
+			continue
+		}
+		a = append(a, v)
+	}
+	return a
+}
+
+// ListUsers returns copies of a page of the users selected by the filter, ordered by ID
+func (db *MapDb) ListUsers(ctx context.Context, filter UserFilter) ([]*model.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sel := db.selectUsers(filter)
+	start, end := pageOf(len(sel), filter.Offset, filter.Limit)
+	a := []*model.User{}
+	for _, v := range sel[start:end] {
+		u := *v
+		a = append(a, &u)
+	}
+	return a, nil
+}
+
+// CountUsers returns the number of users selected by the filter
+func (db *MapDb) CountUsers(ctx context.Context, filter UserFilter) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.selectUsers(filter)), nil
+}
+
+// DeleteUser removes the user and their devices
+func (db *MapDb) DeleteUser(ctx context.Context, id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.users[id] == nil {
+		return ErrNotFound
+	}
+	delete(db.users, id)
+	for k, v := range db.recs {
+		if v.UserID == id {
+			delete(db.recs, k)
+		}
+	}
+	return nil
+}
+
+// RevokeUser soft-deletes the user and their devices
+func (db *MapDb) RevokeUser(ctx context.Context, id uint) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.users[id]
+	if r == nil || r.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	now := time.Now()
+	r.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+	for _, v := range db.recs {
+		if v.UserID == id && !v.DeletedAt.Valid {
+			v.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+		}
+	}
+	return nil
+}
+
+// UpdateUser update registration-editable fields
+func (db *MapDb) UpdateUser(ctx context.Context, user model.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.users[user.ID]
+	if r == nil || r.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	r.UpdatedAt = time.Now()
+	r.Email = user.Email
+	r.IsAdmin = user.IsAdmin
+	r.IsEnabled = user.IsEnabled
+	r.Description = user.Description
+	return nil
 }
 
 // See README.md for info on how to determine the yubikey ID and secret AES key.
-func (db *MapDb) Add(user model.YubiUser) error {
-	r := model.YubiUser{
-		ID:          user.ID,
-		CreatedAt:   time.Now(),
-		Counter:     0,
-		Session:     0,
-		Public:      user.Public,
-		Secret:      user.Secret,
-		Description: user.Description,
-		Email:       user.Email,
-		IsAdmin:     user.IsAdmin,
-		IsEnabled:   user.IsEnabled,
-	}
-	db.recs[user.Public] = &r
+func (db *MapDb) AddDevice(ctx context.Context, device model.Device) error {
+	pid, err := model.NormalizePrivateID(string(device.PrivateID))
+	if err != nil {
+		return err
+	}
+	r := model.Device{
+		ID:        device.ID,
+		CreatedAt: time.Now(),
+		UserID:    device.UserID,
+		Label:     device.Label,
+		IsEnabled: device.IsEnabled,
+		Public:    device.Public,
+		Secret:    device.Secret,
+		PrivateID: model.ColumnSecret(pid),
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if u := db.users[device.UserID]; u == nil || u.DeletedAt.Valid {
+		return fmt.Errorf("device %s has no user %d", device.Public, device.UserID)
+	}
+	if old := db.recs[device.Public]; old != nil {
+		if old.DeletedAt.Valid {
+			return fmt.Errorf("device %s was revoked", device.Public)
+		}
+		return fmt.Errorf("device %s is already registered", device.Public)
+	}
+	db.lastDeviceID++
+	r.ID = db.lastDeviceID
+	db.recs[device.Public] = &r
 
 	return nil
 }
 
-// Find key in database or return an error
-func (db *MapDb) Get(ykid string) (*model.YubiUser, error) {
+// Find key in database or return an error. Returns a copy of the record.
+func (db *MapDb) GetDevice(ctx context.Context, ykid string) (*model.Device, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	r := db.recs[ykid]
-	if r == nil {
-		return nil, errors.New("Not found")
+	if r == nil || r.DeletedAt.Valid {
+		return nil, ErrNotFound
 	}
-	return r, nil
+	d := *r
+	return &d, nil
 }
 
-func (db *MapDb) GetAll() ([]*model.YubiUser, error) {
-	a := []*model.YubiUser{}
-	for _, v := range db.recs {
+// GetDevices returns copies of the devices of a user
+func (db *MapDb) GetDevices(ctx context.Context, userID uint) ([]*model.Device, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a := []*model.Device{}
+	for _, v := range db.sortedDevices() {
+		if v.UserID == userID && !v.DeletedAt.Valid {
+			d := *v
+			a = append(a, &d)
+		}
+	}
+	return a, nil
+}
+
+// selectDevices the devices selected by the filter, ordered by ID. The caller holds mu.
+func (db *MapDb) selectDevices(filter DeviceFilter) []*model.Device {
+	a := []*model.Device{}
+	for _, v := range db.sortedDevices() {
+		if (v.DeletedAt.Valid && !filter.IncludeRevoked) ||
+			(filter.UserID != 0 && v.UserID != filter.UserID) ||
+			(filter.Search != "" && !contains(filter.Search, v.Public, v.Label)) ||
+			(filter.IsEnabled != nil && v.IsEnabled != *filter.IsEnabled) {
+			continue
+		}
 		a = append(a, v)
 	}
+	return a
+}
+
+// ListDevices returns copies of a page of the devices selected by the filter, ordered by ID
+func (db *MapDb) ListDevices(ctx context.Context, filter DeviceFilter) ([]*model.Device, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sel := db.selectDevices(filter)
+	start, end := pageOf(len(sel), filter.Offset, filter.Limit)
+	a := []*model.Device{}
+	for _, v := range sel[start:end] {
+		d := *v
+		a = append(a, &d)
+	}
 	return a, nil
 }
 
-// Intent is we are updating the usage count for the yubikey
-func (db *MapDb) UpdateCounts(rec model.YubiUser) error {
-	db.recs[rec.Public] = &rec
+// CountDevices returns the number of devices selected by the filter
+func (db *MapDb) CountDevices(ctx context.Context, filter DeviceFilter) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.selectDevices(filter)), nil
+}
+
+// DeleteDevice removes the device
+func (db *MapDb) DeleteDevice(ctx context.Context, ykid string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.recs[ykid] == nil {
+		return ErrNotFound
+	}
+	delete(db.recs, ykid)
+	return nil
+}
+
+// RevokeDevice soft-deletes the device
+func (db *MapDb) RevokeDevice(ctx context.Context, ykid string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.recs[ykid]
+	if r == nil || r.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	now := time.Now()
+	r.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+	return nil
+}
+
+// UpdateDevice update registration-editable fields
+func (db *MapDb) UpdateDevice(ctx context.Context, device model.Device) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.recs[device.Public]
+	if r == nil || r.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	r.UpdatedAt = time.Now()
+	r.Label = device.Label
+	r.IsEnabled = device.IsEnabled
 	return nil
 }
 
 // Intent is we are updating the usage count for the yubikey
-func (db *MapDb) UpdateUser(rec model.YubiUser) error {
-	db.recs[rec.Public] = &rec
+func (db *MapDb) UpdateCounts(ctx context.Context, rec model.Device) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.recs[rec.Public]
+	if r == nil || r.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	r.UpdatedAt = time.Now()
+	r.Counter = rec.Counter
+	r.Session = rec.Session
+	r.LastTimestamp = rec.LastTimestamp
+	r.LastSeen = rec.LastSeen
+	return nil
+}
+
+// AdvanceCounts update the usage count for the yubikey only if the stored counters are lower
+func (db *MapDb) AdvanceCounts(ctx context.Context, rec model.Device) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.recs[rec.Public]
+	if r == nil || r.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	if r.Counter > rec.Counter || (r.Counter == rec.Counter && r.Session >= rec.Session) {
+		return common.NewValidationError(common.REPLAYED_OTP, rec.Public, nil)
+	}
+	r.UpdatedAt = time.Now()
+	r.Counter = rec.Counter
+	r.Session = rec.Session
+	r.LastTimestamp = rec.LastTimestamp
+	r.LastSeen = rec.LastSeen
+	return nil
+}
+
+// AddClient registers a client of the validation server
+func (db *MapDb) AddClient(ctx context.Context, client model.APIClient) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.clients[client.ClientID] != nil {
+		return fmt.Errorf("client %s is already registered", client.ClientID)
+	}
+	client.CreatedAt = time.Now()
+	db.clients[client.ClientID] = &client
 	return nil
 }
 
-// SetSecretColumnKeyFunc specifies the func to call to acquire the application's secret key for DB column encryption
-func (db *MapDb) SetSecretColumnKeyFunc(kf model.SecretColumnKeyT) {
-	model.SecretColumnKeyFunc = kf
+// GetClient returns the client with the ClientID or common.NO_SUCH_CLIENT
+func (db *MapDb) GetClient(ctx context.Context, clientID string) (*model.APIClient, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c := db.clients[clientID]
+	if c == nil {
+		return nil, common.NO_SUCH_CLIENT
+	}
+	cc := *c
+	return &cc, nil
+}
+
+func (db *MapDb) GetAllClients(ctx context.Context) ([]*model.APIClient, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a := []*model.APIClient{}
+	for _, v := range db.clients {
+		cc := *v
+		a = append(a, &cc)
+	}
+	return a, nil
+}
+
+// UpdateClient update the editable fields of a client
+func (db *MapDb) UpdateClient(ctx context.Context, client model.APIClient) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c := db.clients[client.ClientID]
+	if c == nil {
+		return common.NO_SUCH_CLIENT
+	}
+	c.UpdatedAt = time.Now()
+	c.IsEnabled = client.IsEnabled
+	c.Owner = client.Owner
+	c.Description = client.Description
+	return nil
+}
+
+// SetSecretColumnKeyFunc does nothing; a MapDb holds the secrets unencrypted
+func (db *MapDb) SetSecretColumnKeyFunc(kf model.SecretColumnKeyT) {}
+
+// SetSecretColumnKeyring does nothing; a MapDb holds the secrets unencrypted
+func (db *MapDb) SetSecretColumnKeyring(kr *model.ColumnKeyring) {}
+
+// SetSecretColumnKeyProvider does nothing; a MapDb holds the secrets unencrypted
+func (db *MapDb) SetSecretColumnKeyProvider(kp model.KeyProvider) {}
+
+// RotateColumnKeys does nothing; a MapDb holds the secrets unencrypted
+func (db *MapDb) RotateColumnKeys(ctx context.Context) (int, error) {
+	return 0, nil
 }
 
 func NewMapDb() *MapDb {
 	db := MapDb{
-		recs: make(map[string]*model.YubiUser),
+		users:   make(map[uint]*model.User),
+		recs:    make(map[string]*model.Device),
+		clients: make(map[string]*model.APIClient),
 	}
 
 	type knownKey struct {
 		ID          string `json:"yubi_id"`
 		Secret      string `json:"yubi_secret"`
+		PrivateID   string `json:"yubi_private_id"`
 		Description string `json:"description"`
 	}
 	type keys struct {
@@ -93,15 +474,18 @@ func NewMapDb() *MapDb {
 		if err == nil {
 			if err = yaml.NewDecoder(fp).Decode(&kk); err == nil {
 				for i := range kk.Keys {
-					r := model.YubiUser{
+					u, _ := db.AddUser(context.Background(), model.User{
 						Email:       kk.Keys[i].ID + "@domain.com",
-						Counter:     0,
-						Session:     0,
-						Public:      kk.Keys[i].ID,
-						Secret:      model.ColumnSecret(kk.Keys[i].Secret),
+						IsEnabled:   true,
 						Description: kk.Keys[i].Description,
-					}
-					_ = db.Add(r)
+					})
+					_ = db.AddDevice(context.Background(), model.Device{
+						UserID:    u.ID,
+						IsEnabled: true,
+						Public:    kk.Keys[i].ID,
+						Secret:    model.ColumnSecret(kk.Keys[i].Secret),
+						PrivateID: model.ColumnSecret(kk.Keys[i].PrivateID),
+					})
 				}
 				log.WithField("nRecords", len(db.recs)).Debug("loaded Yubi DB map")
 			}
@@ -0,0 +1,189 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// SchemaVersionTable the table recording the migrations applied to the database
+const SchemaVersionTable = "schema_version"
+
+// migrationFiles the forward migrations of each dialect, in migrations/<dialect>/<version>_<name>.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration a forward change of the database schema
+type Migration struct {
+	// Version the order of the migration; the versions of a dialect are 1, 2, 3...
+	Version int
+	// Name describes the change
+	Name string
+	// SQL the statements of the migration, each ending with a semicolon at the end of a line
+	SQL string
+	// Requires the tables the migration reads, from its "-- requires: <table>" comment lines. When one does not exist
+	// the migration has nothing to do, and it is recorded as applied without running its statements.
+	Requires []string
+}
+
+// SchemaVersion a migration applied to the database
+type SchemaVersion struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// TableName the table of SchemaVersion records
+func (SchemaVersion) TableName() string {
+	return SchemaVersionTable
+}
+
+// Migrations returns the migrations of a dialect, "sqlite", "mysql" or "postgres", ordered by version
+func Migrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w; no migrations for database dialect %q", err, dialect)
+	}
+	migrations := make([]Migration, 0, len(entries))
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		if e.IsDir() || name == e.Name() {
+			continue
+		}
+		version, desc, ok := strings.Cut(name, "_")
+		m := Migration{Name: desc}
+		if m.Version, err = strconv.Atoi(version); err != nil || !ok {
+			return nil, fmt.Errorf("migration %s/%s is not named <version>_<name>.sql", dialect, e.Name())
+		}
+		b, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m.SQL = string(b)
+		for _, line := range strings.Split(m.SQL, "\n") {
+			if line = strings.TrimSpace(line); strings.HasPrefix(line, "-- requires:") {
+				m.Requires = append(m.Requires, strings.TrimSpace(strings.TrimPrefix(line, "-- requires:")))
+			}
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %s version %d is out of sequence; expected %d", dialect, m.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// Statements splits the SQL of the migration into its statements, without the comment lines
+func (m Migration) Statements() []string {
+	var stmts []string
+	var stmt strings.Builder
+	for _, line := range strings.Split(m.SQL, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		stmt.WriteString(line)
+		stmt.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(stmt.String()))
+			stmt.Reset()
+		}
+	}
+	if s := strings.TrimSpace(stmt.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+// Dialect the name of the database dialect; "sqlite", "mysql" or "postgres"
+func (db *Db) Dialect() string {
+	return db.db.Dialector.Name()
+}
+
+// SchemaVersion returns the version of the last migration applied to the database, 0 when none was
+func (db *Db) SchemaVersion(ctx context.Context) (int, error) {
+	tx := db.db.WithContext(ctx)
+	if !tx.Migrator().HasTable(SchemaVersionTable) {
+		return 0, nil
+	}
+	var version int
+	err := tx.Model(&SchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// PendingMigrations returns the migrations not yet applied to the database, ordered by version. It is an error for the
+// database to be at a version this program does not know of.
+func (db *Db) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	migrations, err := Migrations(db.Dialect())
+	if err != nil {
+		return nil, err
+	}
+	version, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("database schema version %d is newer than the latest migration %d", version,
+			len(migrations))
+	}
+	return migrations[version:], nil
+}
+
+// Migrate applies the pending migrations in order, each in a transaction with its schema_version record. MySQL commits
+// DDL statements implicitly, so a migration that fails there may be partly applied.
+func (db *Db) Migrate(ctx context.Context) error {
+	tx := db.db.WithContext(ctx)
+	if !tx.Migrator().HasTable(SchemaVersionTable) {
+		if err := tx.Migrator().CreateTable(&SchemaVersion{}); err != nil {
+			return fmt.Errorf("%w; unable to create table %s", err, SchemaVersionTable)
+		}
+	}
+	pending, err := db.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		skipped := ""
+		for _, table := range m.Requires {
+			if !tx.Migrator().HasTable(table) {
+				skipped = table
+				break
+			}
+		}
+		err = db.withContext(ctx, func(tx *gorm.DB) error {
+			if skipped != "" {
+				return tx.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			}
+			for _, stmt := range m.Statements() {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("%w; migration %d %s failed", err, m.Version, m.Name)
+		}
+		if skipped != "" {
+			log.WithFields(log.Fields{"version": m.Version, "name": m.Name, "table": skipped}).
+				Info("skipped database migration; no such table")
+			continue
+		}
+		log.WithFields(log.Fields{"version": m.Version, "name": m.Name}).Info("applied database migration")
+	}
+	return nil
+}
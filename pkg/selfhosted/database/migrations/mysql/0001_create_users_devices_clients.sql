@@ -0,0 +1,47 @@
+-- Users, their Yubi devices and the API clients of the verify server.
+-- IF NOT EXISTS adopts databases whose tables were created by gorm AutoMigrate.
+CREATE TABLE IF NOT EXISTS `users` (
+    `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `email` longtext,
+    `is_enabled` boolean,
+    `is_admin` boolean,
+    `description` longtext,
+    `deleted_at` datetime(3) NULL,
+    PRIMARY KEY (`id`),
+    INDEX `idx_users_deleted_at` (`deleted_at`)
+);
+
+CREATE TABLE IF NOT EXISTS `devices` (
+    `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `user_id` bigint unsigned NOT NULL,
+    `label` longtext,
+    `is_enabled` boolean,
+    `counter` bigint,
+    `session` bigint,
+    `last_timestamp` bigint,
+    `last_seen` datetime(3) NULL,
+    `public` varchar(191) NOT NULL UNIQUE,
+    `secret` longtext,
+    `private_id` longtext,
+    `deleted_at` datetime(3) NULL,
+    PRIMARY KEY (`id`),
+    INDEX `idx_devices_deleted_at` (`deleted_at`),
+    INDEX `idx_devices_user_id` (`user_id`),
+    CONSTRAINT `fk_users_devices` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `api_clients` (
+    `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `client_id` varchar(191) NOT NULL UNIQUE,
+    `secret` longtext,
+    `is_enabled` boolean,
+    `owner` longtext,
+    `description` longtext,
+    PRIMARY KEY (`id`)
+);
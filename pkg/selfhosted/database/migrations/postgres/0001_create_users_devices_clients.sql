@@ -0,0 +1,47 @@
+-- Users, their Yubi devices and the API clients of the verify server.
+-- IF NOT EXISTS adopts databases whose tables were created by gorm AutoMigrate.
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "email" text,
+    "is_enabled" boolean,
+    "is_admin" boolean,
+    "description" text,
+    "deleted_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "devices" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "label" text,
+    "is_enabled" boolean,
+    "counter" bigint,
+    "session" bigint,
+    "last_timestamp" bigint,
+    "last_seen" timestamptz,
+    "public" text NOT NULL UNIQUE,
+    "secret" text,
+    "private_id" text,
+    "deleted_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_devices" FOREIGN KEY ("user_id") REFERENCES "users"("id")
+);
+CREATE INDEX IF NOT EXISTS "idx_devices_deleted_at" ON "devices" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_devices_user_id" ON "devices" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "api_clients" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "client_id" text NOT NULL UNIQUE,
+    "secret" text,
+    "is_enabled" boolean,
+    "owner" text,
+    "description" text,
+    PRIMARY KEY ("id")
+);
@@ -0,0 +1,47 @@
+-- Users, their Yubi devices and the API clients of the verify server.
+-- IF NOT EXISTS adopts databases whose tables were created by gorm AutoMigrate.
+CREATE TABLE IF NOT EXISTS `users` (
+    `id` integer,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `email` text,
+    `is_enabled` numeric,
+    `is_admin` numeric,
+    `description` text,
+    `deleted_at` datetime,
+    PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_users_deleted_at` ON `users`(`deleted_at`);
+
+CREATE TABLE IF NOT EXISTS `devices` (
+    `id` integer,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `user_id` integer NOT NULL,
+    `label` text,
+    `is_enabled` numeric,
+    `counter` integer,
+    `session` integer,
+    `last_timestamp` integer,
+    `last_seen` datetime,
+    `public` text NOT NULL UNIQUE,
+    `secret` text,
+    `private_id` text,
+    `deleted_at` datetime,
+    PRIMARY KEY (`id`),
+    CONSTRAINT `fk_users_devices` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_devices_deleted_at` ON `devices`(`deleted_at`);
+CREATE INDEX IF NOT EXISTS `idx_devices_user_id` ON `devices`(`user_id`);
+
+CREATE TABLE IF NOT EXISTS `api_clients` (
+    `id` integer,
+    `created_at` datetime,
+    `updated_at` datetime,
+    `client_id` text NOT NULL UNIQUE,
+    `secret` text,
+    `is_enabled` numeric,
+    `owner` text,
+    `description` text,
+    PRIMARY KEY (`id`)
+);
@@ -0,0 +1,27 @@
+-- Copies the records of the deprecated yubi_users table to users and devices when there are no devices yet. Records
+-- with the same email become devices of one user; a record without an email gets a user of its own. The encrypted
+-- secrets are copied as they are, so that the column key is not needed. Only the columns of the first release are
+-- copied. The migration does nothing when the database has no yubi_users table.
+-- requires: yubi_users
+
+-- The users are marked with the prefix '#yubiusers#' on their email until their devices are copied.
+INSERT INTO `users` (`created_at`, `updated_at`, `email`, `is_enabled`, `is_admin`, `description`)
+SELECT y.`created_at`, y.`updated_at`,
+       '#yubiusers#' || CASE WHEN COALESCE(y.`email`, '') = '' THEN '#' || y.`public` ELSE y.`email` END,
+       y.`is_enabled`, y.`is_admin`, y.`description`
+FROM `yubi_users` y
+WHERE NOT EXISTS (SELECT 1 FROM `devices`)
+  AND y.`id` IN (SELECT MIN(`id`) FROM `yubi_users`
+                 GROUP BY CASE WHEN COALESCE(`email`, '') = '' THEN '#' || `public` ELSE `email` END)
+ORDER BY y.`id`;
+
+INSERT INTO `devices` (`created_at`, `updated_at`, `user_id`, `label`, `is_enabled`, `counter`, `session`,
+                       `last_timestamp`, `public`, `secret`)
+SELECT y.`created_at`, y.`updated_at`, u.`id`, '', y.`is_enabled`, y.`counter`, y.`session`, 0, y.`public`, y.`secret`
+FROM `yubi_users` y
+JOIN `users` u
+  ON u.`email` = '#yubiusers#' || CASE WHEN COALESCE(y.`email`, '') = '' THEN '#' || y.`public` ELSE y.`email` END
+ORDER BY y.`id`;
+
+UPDATE `users` SET `email` = '' WHERE `email` LIKE '#yubiusers##%';
+UPDATE `users` SET `email` = SUBSTR(`email`, 12) WHERE `email` LIKE '#yubiusers#%';
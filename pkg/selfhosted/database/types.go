@@ -1,15 +1,107 @@
 package database
 
-import "github.com/dsggregory/yubiv/pkg/selfhosted/model"
+import (
+	"context"
+	"errors"
 
-// Databaser interface to the underlying database that manages known Yubi keys
+	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
+)
+
+// Databaser interface to the underlying database that manages known Yubi keys.
+// The context of each call carries the deadline and cancellation of the database operation.
 type Databaser interface {
-	Add(user model.YubiUser) error
-	Get(ykid string) (*model.YubiUser, error)
-	GetAll() ([]*model.YubiUser, error)
-	UpdateCounts(user model.YubiUser) error
-	UpdateUser(user model.YubiUser) error
+	// AddUser stores a new user and returns it with its ID. Devices of the user are added with AddDevice().
+	AddUser(ctx context.Context, user model.User) (*model.User, error)
+	// GetUser returns the user with the ID and its devices
+	GetUser(ctx context.Context, id uint) (*model.User, error)
+	// GetUserByEmail returns the user with the email, without its devices, or ErrNotFound
+	GetUserByEmail(ctx context.Context, email string) (*model.User, error)
+	GetAllUsers(ctx context.Context) ([]*model.User, error)
+	// ListUsers returns a page of the users selected by the filter, ordered by ID
+	ListUsers(ctx context.Context, filter UserFilter) ([]*model.User, error)
+	// CountUsers returns the number of users selected by the filter, ignoring its Offset and Limit
+	CountUsers(ctx context.Context, filter UserFilter) (int, error)
+	// UpdateUser updates the registration-editable fields of a user; Email, IsEnabled, IsAdmin and Description,
+	// or returns ErrNotFound
+	UpdateUser(ctx context.Context, user model.User) error
+	// DeleteUser removes the user and their devices, or returns ErrNotFound. The Yubikey IDs may be registered again.
+	DeleteUser(ctx context.Context, id uint) error
+	// RevokeUser soft-deletes the user and their devices, or returns ErrNotFound
+	RevokeUser(ctx context.Context, id uint) error
+	// AddDevice stores a new device of the user device.UserID. It is an error for its Public ID to be registered already,
+	// even to a revoked device.
+	AddDevice(ctx context.Context, device model.Device) error
+	// GetDevice returns the device with the Yubikey ID
+	GetDevice(ctx context.Context, ykid string) (*model.Device, error)
+	// GetDevices returns the devices of a user
+	GetDevices(ctx context.Context, userID uint) ([]*model.Device, error)
+	// ListDevices returns a page of the devices selected by the filter, ordered by ID
+	ListDevices(ctx context.Context, filter DeviceFilter) ([]*model.Device, error)
+	// CountDevices returns the number of devices selected by the filter, ignoring its Offset and Limit
+	CountDevices(ctx context.Context, filter DeviceFilter) (int, error)
+	// DeleteDevice removes the device, or returns ErrNotFound. Its Yubikey ID may be registered again.
+	DeleteDevice(ctx context.Context, ykid string) error
+	// RevokeDevice soft-deletes the device, or returns ErrNotFound
+	RevokeDevice(ctx context.Context, ykid string) error
+	// UpdateDevice updates the registration-editable fields of a device; Label and IsEnabled, or returns ErrNotFound
+	UpdateDevice(ctx context.Context, device model.Device) error
+	UpdateCounts(ctx context.Context, device model.Device) error
+	// AdvanceCounts atomically stores the Counter and Session of the device only if the stored values are lower, else
+	// returns common.REPLAYED_OTP. Validation uses it so that concurrent requests with the same OTP cannot both succeed.
+	AdvanceCounts(ctx context.Context, device model.Device) error
+	// AddClient registers a client of the validation server. A ClientID that is already registered is an error.
+	AddClient(ctx context.Context, client model.APIClient) error
+	// GetClient returns the client with the ClientID or common.NO_SUCH_CLIENT
+	GetClient(ctx context.Context, clientID string) (*model.APIClient, error)
+	GetAllClients(ctx context.Context) ([]*model.APIClient, error)
+	// UpdateClient updates the editable fields of a client; IsEnabled, Owner and Description. Returns
+	// common.NO_SUCH_CLIENT when the client is not registered.
+	UpdateClient(ctx context.Context, client model.APIClient) error
+	// SetSecretColumnKeyFunc specifies the func to call to acquire the secret key for DB column encryption. The keys
+	// are of this database only; see model.ColumnKeys.
 	SetSecretColumnKeyFunc(model.SecretColumnKeyT)
+	// SetSecretColumnKeyring specifies the keyring for DB column encryption, used instead of the key func
+	SetSecretColumnKeyring(*model.ColumnKeyring)
+	// SetSecretColumnKeyProvider specifies the KMS for envelope encryption of DB columns, used instead of the keyring
+	SetSecretColumnKeyProvider(model.KeyProvider)
+	// RotateColumnKeys re-encrypts with the current key of the keyring, or the key provider, the encrypted columns that
+	// need it, and returns the number of records updated
+	RotateColumnKeys(ctx context.Context) (int, error)
+}
+
+// ErrNotFound the record does not exist or was revoked
+var ErrNotFound = errors.New("record not found")
+
+// UserFilter selects the users of ListUsers and CountUsers. Zero values select all.
+type UserFilter struct {
+	// Search matches a substring of the Email or Description
+	Search string
+	// IsEnabled selects enabled or disabled users when not nil
+	IsEnabled *bool
+	// IsAdmin selects admins or other users when not nil
+	IsAdmin *bool
+	// IncludeRevoked also selects revoked users
+	IncludeRevoked bool
+	// Offset the number of selected users to skip
+	Offset int
+	// Limit the maximum number of users to return. Zero returns all.
+	Limit int
+}
+
+// DeviceFilter selects the devices of ListDevices and CountDevices. Zero values select all.
+type DeviceFilter struct {
+	// UserID selects the devices of the user when not zero
+	UserID uint
+	// Search matches a substring of the Yubikey ID or Label
+	Search string
+	// IsEnabled selects enabled or disabled devices when not nil
+	IsEnabled *bool
+	// IncludeRevoked also selects revoked devices
+	IncludeRevoked bool
+	// Offset the number of selected devices to skip
+	Offset int
+	// Limit the maximum number of devices to return. Zero returns all.
+	Limit int
 }
 
 type RegistrationError struct {
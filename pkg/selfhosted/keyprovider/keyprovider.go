@@ -0,0 +1,110 @@
+package keyprovider
+
+/*** Providers of the key-encryption key (KEK) for envelope encryption of the secrets in the self-hosted database. See
+model.KeyProvider. Local holds the KEK in the process, read from the environment or from a file such as a mounted k8s
+secret. VaultTransit leaves the KEK in HashiCorp Vault and asks Vault to wrap and unwrap the data keys.
+*/
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KEKEnv the environment variable holding the base64-encoded KEK of FromEnv()
+const KEKEnv = "DB_COL_KEK"
+
+// KEKSize the size in bytes of the KEK of a Local provider
+const KEKSize = 32
+
+// Local a model.KeyProvider that wraps data keys with AES-256-GCM and a KEK held in the process
+type Local struct {
+	gcm cipher.AEAD
+}
+
+// NewLocal creates a provider of the KEK of KEKSize bytes
+func NewLocal(kek []byte) (*Local, error) {
+	if len(kek) != KEKSize {
+		return nil, fmt.Errorf("KEK must be %d bytes", KEKSize)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{gcm: gcm}, nil
+}
+
+// decodeKEK decodes a base64 KEK and creates its provider. The decoded key is cleared once the cipher has it.
+func decodeKEK(b64 []byte, from string) (*Local, error) {
+	b64 = []byte(strings.TrimSpace(string(b64)))
+	kek := make([]byte, base64.StdEncoding.DecodedLen(len(b64)))
+	n, err := base64.StdEncoding.Decode(kek, b64)
+	defer func() {
+		for i := range kek {
+			kek[i] = 0
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("%w; KEK of %s must be base64", err, from)
+	}
+	return NewLocal(kek[:n])
+}
+
+// FromEnv creates a provider of the base64-encoded KEK of the environment variable `name`, ex. KEKEnv
+func FromEnv(name string) (*Local, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return decodeKEK([]byte(v), name)
+}
+
+// FromFile creates a provider of the base64-encoded KEK of a file, such as a mounted k8s secret
+func FromFile(path string) (*Local, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range b {
+			b[i] = 0
+		}
+	}()
+	return decodeKEK(b, path)
+}
+
+// GenerateKEK returns a new random KEK, base64-encoded as FromEnv() and FromFile() read it
+func GenerateKEK() (string, error) {
+	kek := make([]byte, KEKSize)
+	if _, err := rand.Read(kek); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(kek), nil
+}
+
+// WrapKey encrypts the data key with the KEK
+func (l *Local) WrapKey(_ context.Context, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, l.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return l.gcm.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// UnwrapKey decrypts a data key from WrapKey()
+func (l *Local) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < l.gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+	return l.gcm.Open(nil, wrapped[:l.gcm.NonceSize()], wrapped[l.gcm.NonceSize():], nil)
+}
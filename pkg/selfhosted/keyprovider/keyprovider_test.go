@@ -0,0 +1,145 @@
+package keyprovider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&keyProviderSuite{})
+
+type keyProviderSuite struct {
+}
+
+// vaultStub simulates the encrypt and decrypt endpoints of the Vault Transit secrets engine
+type vaultStub struct {
+	mu    sync.Mutex
+	token string
+	keys  map[string]string
+}
+
+func (v *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	respond := func(status int, resp interface{}) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+	if r.Header.Get("X-Vault-Token") != v.token {
+		respond(http.StatusForbidden, map[string][]string{"errors": {"permission denied"}})
+		return
+	}
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respond(http.StatusBadRequest, map[string][]string{"errors": {err.Error()}})
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/yubiv":
+		ct := fmt.Sprintf("vault:v1:%d", len(v.keys))
+		v.keys[ct] = req["plaintext"]
+		respond(http.StatusOK, map[string]interface{}{"data": map[string]string{"ciphertext": ct}})
+	case "/v1/transit/decrypt/yubiv":
+		pt, ok := v.keys[req["ciphertext"]]
+		if !ok {
+			respond(http.StatusBadRequest, map[string][]string{"errors": {"cipher: message authentication failed"}})
+			return
+		}
+		respond(http.StatusOK, map[string]interface{}{"data": map[string]string{"plaintext": pt}})
+	default:
+		respond(http.StatusNotFound, map[string][]string{"errors": {}})
+	}
+}
+
+// testEnvelope encrypts and decrypts with the provider
+func testEnvelope(c *C, kp model.KeyProvider) {
+	ctx := context.Background()
+	enc, err := model.EnvelopeEncrypt(ctx, kp, []byte("this is a test"), []byte("cccccccccccb"))
+	c.Assert(err, IsNil)
+	pt, err := model.EnvelopeDecrypt(ctx, kp, enc, []byte("cccccccccccb"))
+	c.Assert(err, IsNil)
+	c.Assert(string(pt), Equals, "this is a test")
+	_, err = model.EnvelopeDecrypt(ctx, kp, enc, []byte("cccccccccccd"))
+	c.Assert(err, NotNil)
+}
+
+func (s *keyProviderSuite) TestLocal(c *C) {
+	_, err := NewLocal([]byte("short"))
+	c.Assert(err, NotNil)
+
+	kek, err := GenerateKEK()
+	c.Assert(err, IsNil)
+	c.Assert(os.Setenv("TEST_DB_COL_KEK", kek), IsNil)
+	defer func() { _ = os.Unsetenv("TEST_DB_COL_KEK") }()
+	fromEnv, err := FromEnv("TEST_DB_COL_KEK")
+	c.Assert(err, IsNil)
+	testEnvelope(c, fromEnv)
+	_, err = FromEnv("TEST_DB_COL_KEK_UNSET")
+	c.Assert(err, NotNil)
+
+	path := filepath.Join(c.MkDir(), "kek")
+	c.Assert(os.WriteFile(path, []byte(kek+"\n"), 0600), IsNil)
+	fromFile, err := FromFile(path)
+	c.Assert(err, IsNil)
+	testEnvelope(c, fromFile)
+
+	// the same KEK unwraps the data keys of the other
+	ctx := context.Background()
+	wrapped, err := fromEnv.WrapKey(ctx, []byte("data key"))
+	c.Assert(err, IsNil)
+	dk, err := fromFile.UnwrapKey(ctx, wrapped)
+	c.Assert(err, IsNil)
+	c.Assert(string(dk), Equals, "data key")
+
+	other, err := GenerateKEK()
+	c.Assert(err, IsNil)
+	raw, err := base64.StdEncoding.DecodeString(other)
+	c.Assert(err, IsNil)
+	l, err := NewLocal(raw)
+	c.Assert(err, IsNil)
+	_, err = l.UnwrapKey(ctx, wrapped)
+	c.Assert(err, NotNil)
+}
+
+func (s *keyProviderSuite) TestVaultTransit(c *C) {
+	stub := &vaultStub{token: "s.test", keys: make(map[string]string)}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	vt := NewVaultTransit(ts.URL, "yubiv", "s.test")
+	testEnvelope(c, vt)
+	wrapped, err := vt.WrapKey(context.Background(), []byte("data key"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(wrapped), "vault:v1:"), Equals, true)
+
+	vt.Token = "s.bad"
+	_, err = vt.UnwrapKey(context.Background(), wrapped)
+	c.Assert(err, ErrorMatches, ".*403 Forbidden: permission denied")
+
+	c.Assert(os.Setenv("VAULT_ADDR", ts.URL), IsNil)
+	c.Assert(os.Setenv("VAULT_TOKEN", "s.test"), IsNil)
+	defer func() {
+		_ = os.Unsetenv("VAULT_ADDR")
+		_ = os.Unsetenv("VAULT_TOKEN")
+	}()
+	vt, err = VaultTransitFromEnv("yubiv")
+	c.Assert(err, IsNil)
+	dk, err := vt.UnwrapKey(context.Background(), wrapped)
+	c.Assert(err, IsNil)
+	c.Assert(string(dk), Equals, "data key")
+}
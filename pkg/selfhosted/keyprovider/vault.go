@@ -0,0 +1,121 @@
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultTransitMount the default path of the Vault Transit secrets engine
+const DefaultTransitMount = "transit"
+
+// VaultTransit a model.KeyProvider that wraps data keys with a key of the HashiCorp Vault Transit secrets engine. The
+// KEK never leaves Vault; rotating it in Vault leaves the wrapped data keys readable.
+// See https://developer.hashicorp.com/vault/api-docs/secret/transit
+type VaultTransit struct {
+	// Addr the address of Vault, ex. "https://vault.example.com:8200"
+	Addr string
+	// Mount the path of the Transit secrets engine. Default is DefaultTransitMount.
+	Mount string
+	// Key the name of the Transit key that wraps the data keys
+	Key string
+	// Token a Vault token allowed to update <mount>/encrypt/<key> and <mount>/decrypt/<key>
+	Token string
+	// Namespace the Vault Enterprise namespace, if any
+	Namespace string
+	// HTTPClient the client used for requests. Default is http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// NewVaultTransit creates a provider of the Transit key `key` of the Vault at `addr`
+func NewVaultTransit(addr string, key string, token string) *VaultTransit {
+	return &VaultTransit{Addr: addr, Mount: DefaultTransitMount, Key: key, Token: token, HTTPClient: http.DefaultClient}
+}
+
+// VaultTransitFromEnv creates a provider of the Transit key `key` of the Vault of the environment variables used by the
+// Vault CLI; VAULT_ADDR, VAULT_TOKEN and the optional VAULT_NAMESPACE
+func VaultTransitFromEnv(key string) (*VaultTransit, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	v := NewVaultTransit(addr, key, token)
+	v.Namespace = os.Getenv("VAULT_NAMESPACE")
+	return v, nil
+}
+
+// transit calls the Transit endpoint `op` of the key with the request and decodes the data of the response into resp
+func (v *VaultTransit) transit(ctx context.Context, op string, req interface{}, resp interface{}) error {
+	mount := v.Mount
+	if mount == "" {
+		mount = DefaultTransitMount
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s/%s/%s", strings.TrimRight(v.Addr, "/"), strings.Trim(mount, "/"), op, v.Key)
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		hreq.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	hc := v.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	hresp, err := hc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	rbody, err := io.ReadAll(io.LimitReader(hresp.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+
+	var vresp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err = json.Unmarshal(rbody, &vresp); err != nil && hresp.StatusCode == http.StatusOK {
+		return fmt.Errorf("%w; Vault transit %s response", err, op)
+	}
+	if hresp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Vault transit %s responded %s: %s", op, hresp.Status, strings.Join(vresp.Errors, "; "))
+	}
+	return json.Unmarshal(vresp.Data, resp)
+}
+
+// WrapKey asks Vault to encrypt the data key. The wrapped key is the Vault ciphertext, "vault:v<version>:...".
+func (v *VaultTransit) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := v.transit(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(resp.Ciphertext), nil
+}
+
+// UnwrapKey asks Vault to decrypt a data key from WrapKey()
+func (v *VaultTransit) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.transit(ctx, "decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,140 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeyProvider holds the key-encryption key (KEK) of envelope encryption. Each encrypted value has its own random data
+// key, which the provider wraps with the KEK and which is stored, wrapped, with the value. The KEK itself may stay
+// in a KMS, such as HashiCorp Vault, and never be in the memory of the process. See package keyprovider.
+type KeyProvider interface {
+	// WrapKey encrypts a data key with the KEK
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped by WrapKey()
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// SecretColumnKeyProvider when set, ColumnSecret columns are written with envelope encryption by this provider
+// instead of with SecretColumnKeyring or SecretColumnKeyFunc. Those still decrypt the values written before.
+var SecretColumnKeyProvider KeyProvider
+
+// cipherV3 the prefix of the envelope format, "$3$<base64 wrapped data key>$<hex nonce and ciphertext>"
+const cipherV3 = "$3$"
+
+// dataKeySize the size in bytes of the AES-256 data key of a value
+const dataKeySize = 32
+
+// isEnvelope is the encrypted value of the envelope format?
+func isEnvelope(enc string) bool {
+	return strings.HasPrefix(enc, cipherV3)
+}
+
+// EnvelopeEncrypt encrypts bytes with AES-256-GCM, a new data key and the associated data `aad`, and returns them with
+// the data key wrapped by the provider
+func EnvelopeEncrypt(ctx context.Context, kp KeyProvider, data []byte, aad []byte) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	wrapped, err := kp.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("%w; unable to wrap data key", err)
+	}
+	ciphertext := gcm.Seal(nonce, nonce, data, aad)
+	return fmt.Sprintf("%s%s$%x", cipherV3, base64.StdEncoding.EncodeToString(wrapped), ciphertext), nil
+}
+
+// EnvelopeDecrypt decrypts a string from EnvelopeEncrypt() with the data key unwrapped by the provider
+func EnvelopeDecrypt(ctx context.Context, kp KeyProvider, enc string, aad []byte) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(enc, cipherV3), "$")
+	if !isEnvelope(enc) || len(parts) != 2 {
+		return nil, fmt.Errorf("malformed encrypted value")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := kp.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w; unable to unwrap data key", err)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if _, err = fmt.Sscanf(parts[1], "%x", &data); err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted value")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], aad)
+}
+
+// EncryptColumn encrypts the value of a ColumnSecret column with the key provider of the context when set, else with
+// its keyring; see WithColumnKeys()
+func EncryptColumn(ctx context.Context, data []byte, aad []byte) (string, error) {
+	keys := columnKeys(ctx)
+	if keys.Provider != nil {
+		return EnvelopeEncrypt(ctx, keys.Provider, data, aad)
+	}
+	kr, err := keys.keyring()
+	if err != nil {
+		return "", err
+	}
+	return kr.Encrypt(data, aad)
+}
+
+// DecryptColumn decrypts the value of a ColumnSecret column with the key provider of the context when it is of the
+// envelope format, else with the keyring
+func DecryptColumn(ctx context.Context, enc string, aad []byte) ([]byte, error) {
+	keys := columnKeys(ctx)
+	if isEnvelope(enc) {
+		if keys.Provider == nil {
+			return nil, fmt.Errorf("SecretColumnKeyProvider not initialized")
+		}
+		return EnvelopeDecrypt(ctx, keys.Provider, enc, aad)
+	}
+	kr, err := keys.keyring()
+	if err != nil {
+		return nil, err
+	}
+	return kr.Decrypt(enc, aad)
+}
+
+// ColumnNeedsRotation does the value of a ColumnSecret column need to be re-encrypted? With a key provider in the
+// context, values not of the envelope format do. Else, see ColumnKeyring.NeedsRotation(). Values of the envelope
+// format are rotated by the KMS rewrapping their data keys.
+func ColumnNeedsRotation(ctx context.Context, enc string) (bool, error) {
+	keys := columnKeys(ctx)
+	if keys.Provider != nil {
+		return !isEnvelope(enc), nil
+	}
+	if keys.Keyring == nil {
+		return false, fmt.Errorf("no column keyring or key provider to rotate to")
+	}
+	return !isEnvelope(enc) && keys.Keyring.NeedsRotation(enc), nil
+}
+
+// ReencryptColumn decrypts the value of a ColumnSecret column and encrypts it again as EncryptColumn() does
+func ReencryptColumn(ctx context.Context, enc string, aad []byte) (string, error) {
+	data, err := DecryptColumn(ctx, enc, aad)
+	if err != nil {
+		return "", err
+	}
+	return EncryptColumn(ctx, data, aad)
+}
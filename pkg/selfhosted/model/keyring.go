@@ -0,0 +1,90 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyIDSeparator separates the key ID from the hex ciphertext of a ColumnSecret. Hex never contains it.
+const keyIDSeparator = ":"
+
+// ColumnKeyring the keys of ColumnSecret columns by key ID, for key rotation. Values are encrypted with the Current
+// key and prefixed with its ID, "<keyID>:<hex>". They are decrypted with the key of the ID they carry, so that older
+// keys still decrypt after a rotation until the values are re-encrypted with Databaser.RotateColumnKeys().
+//
+// Values written before keyrings, with SecretColumnKeyFunc, carry no key ID. They are decrypted with the key of the
+// empty ID.
+type ColumnKeyring struct {
+	current string
+	keys    map[string]string
+}
+
+// SecretColumnKeyring when set, encrypts and decrypts ColumnSecret columns instead of SecretColumnKeyFunc
+var SecretColumnKeyring *ColumnKeyring
+
+// NewColumnKeyring creates a keyring that encrypts with the key of the `current` ID. `keys` maps key IDs to keys and
+// must hold the current one. Add the key that SecretColumnKeyFunc returned with the empty ID to read the values it
+// encrypted.
+func NewColumnKeyring(current string, keys map[string]string) (*ColumnKeyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("the current key %q is not in the keyring", current)
+	}
+	kr := &ColumnKeyring{current: current, keys: make(map[string]string, len(keys))}
+	for id, key := range keys {
+		if strings.Contains(id, keyIDSeparator) {
+			return nil, fmt.Errorf("key ID %q may not contain %q", id, keyIDSeparator)
+		}
+		kr.keys[id] = key
+	}
+	return kr, nil
+}
+
+// Current the ID of the key that encrypts
+func (kr *ColumnKeyring) Current() string {
+	return kr.current
+}
+
+// KeyID returns the ID of the key that encrypted a value; the empty ID when it carries none
+func KeyID(enc string) string {
+	id, _, ok := strings.Cut(enc, keyIDSeparator)
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// Encrypt encrypts with the current key and the associated data `aad`, see EncryptAAD(), and prefixes the value with
+// the key ID. The empty current ID writes values without a prefix, as SecretColumnKeyFunc does.
+func (kr *ColumnKeyring) Encrypt(data []byte, aad []byte) (string, error) {
+	enc, err := EncryptAAD(data, kr.keys[kr.current], aad)
+	if err != nil || kr.current == "" {
+		return enc, err
+	}
+	return kr.current + keyIDSeparator + enc, nil
+}
+
+// Decrypt decrypts with the key of the ID the value carries and the associated data it was encrypted with
+func (kr *ColumnKeyring) Decrypt(enc string, aad []byte) ([]byte, error) {
+	id := KeyID(enc)
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("column key %q is not in the keyring", id)
+	}
+	return DecryptAAD(strings.TrimPrefix(enc, id+keyIDSeparator), key, aad)
+}
+
+// NeedsRotation does the value need to be re-encrypted with the current key, or in the current format?
+func (kr *ColumnKeyring) NeedsRotation(enc string) bool {
+	id := KeyID(enc)
+	return id != kr.current || !isCurrentFormat(strings.TrimPrefix(enc, id+keyIDSeparator))
+}
+
+// Reencrypt decrypts the value with the key it carries and encrypts it with the current key, in the current format.
+// Values of the legacy format are then bound to `aad`.
+func (kr *ColumnKeyring) Reencrypt(enc string, aad []byte) (string, error) {
+	data, err := kr.Decrypt(enc, aad)
+	if err != nil {
+		return "", err
+	}
+	return kr.Encrypt(data, aad)
+}
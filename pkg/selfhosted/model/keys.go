@@ -0,0 +1,55 @@
+package model
+
+import (
+	"context"
+	"fmt"
+)
+
+// ColumnKeys the keys of the ColumnSecret columns of one database. A database that sets them, see
+// database.Databaser.SetSecretColumnKeyFunc(), binds them to the context of its queries with WithColumnKeys() so that
+// databases of the same process may have different keys. A key that is not set falls back to the package variable;
+// SecretColumnKeyFunc, SecretColumnKeyring or SecretColumnKeyProvider.
+type ColumnKeys struct {
+	KeyFunc  SecretColumnKeyT
+	Keyring  *ColumnKeyring
+	Provider KeyProvider
+}
+
+// columnKeysKey the context key of the ColumnKeys of a query
+type columnKeysKey struct{}
+
+// WithColumnKeys returns a context with which ColumnSecret columns are encrypted and decrypted with the keys
+func WithColumnKeys(ctx context.Context, keys *ColumnKeys) context.Context {
+	return context.WithValue(ctx, columnKeysKey{}, keys)
+}
+
+// columnKeys returns the keys of the context, the package variables filling in those it does not set
+func columnKeys(ctx context.Context) ColumnKeys {
+	keys := ColumnKeys{KeyFunc: SecretColumnKeyFunc, Keyring: SecretColumnKeyring, Provider: SecretColumnKeyProvider}
+	if ctx == nil {
+		return keys
+	}
+	if ck, ok := ctx.Value(columnKeysKey{}).(*ColumnKeys); ok && ck != nil {
+		if ck.KeyFunc != nil {
+			keys.KeyFunc = ck.KeyFunc
+		}
+		if ck.Keyring != nil {
+			keys.Keyring = ck.Keyring
+		}
+		if ck.Provider != nil {
+			keys.Provider = ck.Provider
+		}
+	}
+	return keys
+}
+
+// keyring returns the Keyring, or a keyring of the key of KeyFunc with the empty ID
+func (keys ColumnKeys) keyring() (*ColumnKeyring, error) {
+	if keys.Keyring != nil {
+		return keys.Keyring, nil
+	}
+	if keys.KeyFunc == nil {
+		return nil, fmt.Errorf("SecretColumnKeyFunc not initialized")
+	}
+	return &ColumnKeyring{keys: map[string]string{"": keys.KeyFunc()}}, nil
+}
@@ -1,23 +1,33 @@
 package model
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql/driver"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
 )
 
 // ColumnSecret a type for a gorm model column whose value is encrypted before persisting to
 // the database and is unencrypted in the struct.
 //
 // Provides a column type to database/sql/driver whose value is encrypted when persisting to the database.
-// The encryption is AES256 with a nonce.
-// The variable DefaultColumnSecretKey is used for encryption and decryption and must be supplied by the calling function which could originate
-// from a k8s secret, for instance.
+// The encryption is AES256-GCM with a nonce and a key derived from the passphrase; see Encrypt(). Model fields tagged
+// `gorm:"serializer:secret"` are also bound to their record; see SecretSerializer.
+// The variable SecretColumnKeyFunc, or SecretColumnKeyring to rotate keys, is used for encryption and decryption and must
+// be supplied by the calling function which could originate from a k8s secret, for instance. SecretColumnKeyProvider
+// instead encrypts with a data key per value, wrapped by a KMS; see KeyProvider. Those variables are the keys of the
+// process; a database may have its own, see ColumnKeys.
 type ColumnSecret string
 
 // SecretColumnKeyT the type of function that acquires the secret column key
@@ -28,19 +38,15 @@ var SecretColumnKeyFunc SecretColumnKeyT
 
 // when the DB driver writes to DB
 func (sec ColumnSecret) Value() (driver.Value, error) {
-	if SecretColumnKeyFunc == nil {
-		return nil, fmt.Errorf("SecretColumnKeyFunc not initialized")
+	enc, err := EncryptColumn(context.Background(), []byte(sec), nil)
+	if err != nil {
+		return nil, err
 	}
-	// enc the string in b64
-	enc, err := Encrypt([]byte(sec), SecretColumnKeyFunc())
-	return driver.Value(enc), err
+	return driver.Value(enc), nil
 }
 
 // when the DB driver reads from the DB
 func (sec *ColumnSecret) Scan(src interface{}) error {
-	if SecretColumnKeyFunc == nil {
-		return fmt.Errorf("SecretColumnKeyFunc not initialized")
-	}
 	// dec the src string
 	var sb []byte
 	switch v := src.(type) {
@@ -51,11 +57,12 @@ func (sec *ColumnSecret) Scan(src interface{}) error {
 	default:
 		return fmt.Errorf("ColumnSecret src unsupported type %T", v)
 	}
-	dec, err := Decrypt(string(sb), SecretColumnKeyFunc())
+	dec, err := DecryptColumn(context.Background(), string(sb), nil)
 	*sec = ColumnSecret(dec)
 	return err
 }
 
+// createHash the key derivation of the legacy format; the first 32 hex characters of SHA-256 of the passphrase
 func createHash(key string) string {
 	hmac := sha256.New()
 	_, _ = hmac.Write([]byte(key))
@@ -63,13 +70,174 @@ func createHash(key string) string {
 	return x[:32] // aes.NewCipher() requires a 32-byte key for aes256
 }
 
-// Encrypt bytes and return a hex encoding. Uses a nonce so two calls on the same data&pass result in diff values.
+const (
+	// cipherV2 the prefix of the current format, "$2$<kdf>$<hex salt>$<hex nonce and ciphertext>". Values of the
+	// legacy format are the hex nonce and ciphertext only, encrypted with the key of createHash().
+	cipherV2 = "$2$"
+	// RawKeyPrefix marks a key that is random bytes, base64-encoded, rather than a passphrase. Ex.
+	// "base64:<44 characters>". A raw key of at least 32 bytes is expanded with HKDF-SHA256; a passphrase is stretched
+	// with Argon2id.
+	RawKeyPrefix = "base64:"
+	// kdfArgon2id and kdfHKDF name the key derivation of a value
+	kdfArgon2id = "argon2id"
+	kdfHKDF     = "hkdf"
+	// saltSize the size in bytes of the salt of the key derivation
+	saltSize = 16
+	// minRawKeySize the minimum size in bytes of a raw key
+	minRawKeySize = 32
+)
+
+// Argon2id parameters of the $2$ format, the second recommendation of RFC 9106
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// hkdfInfo binds keys expanded with HKDF to their use
+var hkdfInfo = []byte("yubiv column secret v2")
+
+// maxDerivedKeys the most keys that derivedKeys holds. The oldest is evicted to add another, so that values with many
+// salts do not grow the cache without bound.
+const maxDerivedKeys = 256
+
+// derivedKey a key of derivedKeys; done is closed once the key is derived
+type derivedKey struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+// derivedKeys caches the AES keys derived from a passphrase and salt, since Argon2id is deliberately slow. Values are
+// encrypted with one salt per passphrase for the life of the process, so that the cache stays small.
+var derivedKeys = struct {
+	sync.Mutex
+	// keys by passphrase hash, kdf and salt
+	keys map[string]*derivedKey
+	// ids the IDs of keys, oldest first
+	ids []string
+	// salts by passphrase hash, used to encrypt
+	salts map[string][]byte
+}{keys: make(map[string]*derivedKey), salts: make(map[string][]byte)}
+
+// passphraseKDF returns the key derivation of the passphrase; HKDF for a raw key, else Argon2id
+func passphraseKDF(passphrase string) string {
+	if strings.HasPrefix(passphrase, RawKeyPrefix) {
+		return kdfHKDF
+	}
+	return kdfArgon2id
+}
+
+// deriveKey returns the AES-256 key of the passphrase and salt from derivedKeys, deriving it when it is not there.
+// The key is derived without holding the lock; concurrent callers of the same key wait for the one deriving it.
+func deriveKey(passphrase string, kdf string, salt []byte) ([]byte, error) {
+	ph := sha256.Sum256([]byte(passphrase))
+	id := fmt.Sprintf("%x$%s$%x", ph, kdf, salt)
+	derivedKeys.Lock()
+	dk, ok := derivedKeys.keys[id]
+	if !ok {
+		dk = &derivedKey{done: make(chan struct{})}
+		derivedKeys.keys[id] = dk
+		derivedKeys.ids = append(derivedKeys.ids, id)
+		if len(derivedKeys.ids) > maxDerivedKeys {
+			delete(derivedKeys.keys, derivedKeys.ids[0])
+			derivedKeys.ids = derivedKeys.ids[1:]
+		}
+	}
+	derivedKeys.Unlock()
+	if ok {
+		<-dk.done
+		return dk.key, dk.err
+	}
+
+	dk.key, dk.err = newDerivedKey(passphrase, kdf, salt)
+	close(dk.done)
+	if dk.err != nil {
+		// not cached, so that it is tried again
+		derivedKeys.Lock()
+		if derivedKeys.keys[id] == dk {
+			delete(derivedKeys.keys, id)
+			for i := range derivedKeys.ids {
+				if derivedKeys.ids[i] == id {
+					derivedKeys.ids = append(derivedKeys.ids[:i], derivedKeys.ids[i+1:]...)
+					break
+				}
+			}
+		}
+		derivedKeys.Unlock()
+	}
+	return dk.key, dk.err
+}
+
+// newDerivedKey derives the AES-256 key of the passphrase and salt
+func newDerivedKey(passphrase string, kdf string, salt []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	switch kdf {
+	case kdfArgon2id:
+		if strings.HasPrefix(passphrase, RawKeyPrefix) {
+			return nil, fmt.Errorf("a raw key may not be used with %s", kdf)
+		}
+		key = argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, uint32(len(key)))
+	case kdfHKDF:
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(passphrase, RawKeyPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%w; raw key must be base64", err)
+		}
+		if len(raw) < minRawKeySize {
+			return nil, fmt.Errorf("raw key must be at least %d bytes", minRawKeySize)
+		}
+		if _, err = io.ReadFull(hkdf.New(sha256.New, raw, salt, hkdfInfo), key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %q", kdf)
+	}
+	return key, nil
+}
+
+// encryptionKey returns the salt of the passphrase for this process and the key derived from them
+func encryptionKey(passphrase string) (string, []byte, []byte, error) {
+	ph := fmt.Sprintf("%x", sha256.Sum256([]byte(passphrase)))
+	derivedKeys.Lock()
+	salt, ok := derivedKeys.salts[ph]
+	if !ok {
+		salt = make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			derivedKeys.Unlock()
+			return "", nil, nil, err
+		}
+		derivedKeys.salts[ph] = salt
+	}
+	derivedKeys.Unlock()
+	kdf := passphraseKDF(passphrase)
+	key, err := deriveKey(passphrase, kdf, salt)
+	return kdf, salt, key, err
+}
+
+// newGCM returns AES-256-GCM with the key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt bytes and return them in the current format. Uses a nonce so two calls on the same data&pass result in diff
+// values. See EncryptAAD().
 func Encrypt(data []byte, passphrase string) (string, error) {
-	block, err := aes.NewCipher([]byte(createHash(passphrase)))
+	return EncryptAAD(data, passphrase, nil)
+}
+
+// EncryptAAD encrypts bytes with AES-256-GCM and returns "$2$<kdf>$<hex salt>$<hex nonce and ciphertext>". The key
+// is derived from the passphrase and a stored salt; see RawKeyPrefix. The associated data `aad` is not stored, but
+// must be given again to decrypt. It binds the value to its context, such as the Yubikey ID of its record.
+func EncryptAAD(data []byte, passphrase string, aad []byte) (string, error) {
+	kdf, salt, key, err := encryptionKey(passphrase)
 	if err != nil {
 		return "", err
 	}
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
@@ -78,18 +246,37 @@ func Encrypt(data []byte, passphrase string) (string, error) {
 		return "", err
 	}
 	// nonce is stored with the encrypted data to be used in decryption
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return fmt.Sprintf("%x", ciphertext), nil
+	ciphertext := gcm.Seal(nonce, nonce, data, aad)
+	return fmt.Sprintf("%s%s$%x$%x", cipherV2, kdf, salt, ciphertext), nil
 }
 
-// Decrypt a hex encoded string (from Encrypt()) and return the plaintext bytes
+// Decrypt a string (from Encrypt()) and return the plaintext bytes. See DecryptAAD().
 func Decrypt(xdata string, passphrase string) ([]byte, error) {
+	return DecryptAAD(xdata, passphrase, nil)
+}
+
+// DecryptAAD decrypts a string from EncryptAAD() with the same associated data. Values of the legacy format, which
+// have no associated data, are decrypted with the legacy key derivation and `aad` is ignored.
+func DecryptAAD(xdata string, passphrase string, aad []byte) ([]byte, error) {
 	key := []byte(createHash(passphrase))
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+	if strings.HasPrefix(xdata, cipherV2) {
+		parts := strings.Split(strings.TrimPrefix(xdata, cipherV2), "$")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("malformed encrypted value")
+		}
+		salt, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if key, err = deriveKey(passphrase, parts[0], salt); err != nil {
+			return nil, err
+		}
+		xdata = parts[2]
+	} else {
+		// the legacy format has no associated data
+		aad = nil
 	}
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -98,10 +285,18 @@ func Decrypt(xdata string, passphrase string) ([]byte, error) {
 	if _, err = fmt.Sscanf(xdata, "%x", &data); err != nil {
 		return nil, err
 	}
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("malformed encrypted value")
+	}
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
 	if err != nil {
 		return nil, err
 	}
 	return plaintext, nil
 }
+
+// isCurrentFormat is the encrypted value, without its key ID, of the current format?
+func isCurrentFormat(enc string) bool {
+	return strings.HasPrefix(enc, cipherV2)
+}
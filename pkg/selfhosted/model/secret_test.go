@@ -1,6 +1,10 @@
 package model
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -58,3 +62,132 @@ func (s *secretColumnSuite) TestSizeData(c *C) {
 
 	_ = testEncDec(c, string(plaintext), "x")
 }
+
+func (s *secretColumnSuite) TestKeyring(c *C) {
+	_, err := NewColumnKeyring("2026", map[string]string{"2025": "old key"})
+	c.Assert(err, NotNil)
+	_, err = NewColumnKeyring("a:b", map[string]string{"a:b": "key"})
+	c.Assert(err, NotNil)
+
+	plaintext := "this is a test"
+	legacy, err := Encrypt([]byte(plaintext), "legacy key")
+	c.Assert(err, IsNil)
+	old, err := NewColumnKeyring("2025", map[string]string{"": "legacy key", "2025": "old key"})
+	c.Assert(err, IsNil)
+	enc, err := old.Encrypt([]byte(plaintext), nil)
+	c.Assert(err, IsNil)
+	c.Assert(KeyID(enc), Equals, "2025")
+	c.Assert(KeyID(legacy), Equals, "")
+
+	kr, err := NewColumnKeyring("2026", map[string]string{"": "legacy key", "2025": "old key", "2026": "new key"})
+	c.Assert(err, IsNil)
+	for _, v := range []string{legacy, enc} {
+		c.Assert(kr.NeedsRotation(v), Equals, true)
+		pt, err := kr.Decrypt(v, nil)
+		c.Assert(err, IsNil)
+		c.Assert(string(pt), Equals, plaintext)
+		re, err := kr.Reencrypt(v, nil)
+		c.Assert(err, IsNil)
+		c.Assert(KeyID(re), Equals, "2026")
+		c.Assert(kr.NeedsRotation(re), Equals, false)
+	}
+
+	// the key of 2025 was retired
+	retired, err := NewColumnKeyring("2026", map[string]string{"2026": "new key"})
+	c.Assert(err, IsNil)
+	_, err = retired.Decrypt(enc, nil)
+	c.Assert(err, ErrorMatches, `column key "2025" is not in the keyring`)
+}
+
+// encryptLegacy encrypts in the format before key derivation was versioned
+func encryptLegacy(c *C, data []byte, passphrase string) string {
+	gcm, err := newGCM([]byte(createHash(passphrase)))
+	c.Assert(err, IsNil)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	c.Assert(err, IsNil)
+	return fmt.Sprintf("%x", gcm.Seal(nonce, nonce, data, nil))
+}
+
+func (s *secretColumnSuite) TestFormat(c *C) {
+	plaintext := "this is a test"
+	key := "abcdef123"
+
+	// the legacy format still decrypts, with or without associated data
+	legacy := encryptLegacy(c, []byte(plaintext), key)
+	for _, aad := range [][]byte{nil, []byte("cccccccccccb")} {
+		pt, err := DecryptAAD(legacy, key, aad)
+		c.Assert(err, IsNil)
+		c.Assert(string(pt), Equals, plaintext)
+	}
+
+	enc, err := EncryptAAD([]byte(plaintext), key, []byte("cccccccccccb"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(enc, "$2$argon2id$"), Equals, true)
+	pt, err := DecryptAAD(enc, key, []byte("cccccccccccb"))
+	c.Assert(err, IsNil)
+	c.Assert(string(pt), Equals, plaintext)
+	// bound to its record
+	_, err = DecryptAAD(enc, key, []byte("cccccccccccd"))
+	c.Assert(err, NotNil)
+	_, err = Decrypt(enc, key)
+	c.Assert(err, NotNil)
+
+	// raw keys are expanded with HKDF
+	raw := make([]byte, 32)
+	_, err = rand.Read(raw)
+	c.Assert(err, IsNil)
+	rawKey := RawKeyPrefix + base64.StdEncoding.EncodeToString(raw)
+	enc = testEncDec(c, plaintext, rawKey)
+	c.Assert(strings.HasPrefix(enc, "$2$hkdf$"), Equals, true)
+	_, err = Encrypt([]byte(plaintext), RawKeyPrefix+base64.StdEncoding.EncodeToString(raw[:16]))
+	c.Assert(err, ErrorMatches, "raw key must be at least 32 bytes")
+
+	kr, err := NewColumnKeyring("", map[string]string{"": key})
+	c.Assert(err, IsNil)
+	c.Assert(kr.NeedsRotation(legacy), Equals, true)
+	re, err := kr.Reencrypt(legacy, []byte("cccccccccccb"))
+	c.Assert(err, IsNil)
+	c.Assert(kr.NeedsRotation(re), Equals, false)
+	_, err = kr.Decrypt(re, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *secretColumnSuite) TestDerivedKeys(c *C) {
+	raw := make([]byte, minRawKeySize)
+	_, err := rand.Read(raw)
+	c.Assert(err, IsNil)
+	passphrase := RawKeyPrefix + base64.StdEncoding.EncodeToString(raw)
+
+	// the cache is bounded, whatever the number of salts
+	for i := 0; i < maxDerivedKeys+10; i++ {
+		_, err = deriveKey(passphrase, kdfHKDF, []byte(fmt.Sprintf("salt %d", i)))
+		c.Assert(err, IsNil)
+	}
+	derivedKeys.Lock()
+	c.Assert(len(derivedKeys.keys), Equals, maxDerivedKeys)
+	c.Assert(len(derivedKeys.ids), Equals, maxDerivedKeys)
+	derivedKeys.Unlock()
+
+	// a key is derived once for concurrent callers
+	salt := []byte("concurrent salt")
+	keys := make(chan []byte, 4)
+	for i := 0; i < cap(keys); i++ {
+		go func() {
+			key, _ := deriveKey("abcdef123", kdfArgon2id, salt)
+			keys <- key
+		}()
+	}
+	first := <-keys
+	c.Assert(first, HasLen, 32)
+	for i := 1; i < cap(keys); i++ {
+		c.Assert(<-keys, DeepEquals, first)
+	}
+
+	// errors are not cached
+	_, err = deriveKey(RawKeyPrefix+"c2hvcnQ=", kdfHKDF, salt)
+	c.Assert(err, ErrorMatches, "raw key must be at least.*")
+	derivedKeys.Lock()
+	c.Assert(len(derivedKeys.keys), Equals, len(derivedKeys.ids))
+	derivedKeys.Unlock()
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// SecretSerializerName the name of SecretSerializer in gorm tags; `gorm:"serializer:secret"`
+const SecretSerializerName = "secret"
+
+func init() {
+	schema.RegisterSerializer(SecretSerializerName, SecretSerializer{})
+}
+
+// SecretBinder a model whose encrypted columns are bound to the identity of its record, so that an encrypted value
+// copied to another record does not decrypt
+type SecretBinder interface {
+	// SecretAAD the associated data of the encrypted columns of the record
+	SecretAAD() []byte
+}
+
+// SecretSerializer the gorm serializer of ColumnSecret fields. It encrypts as ColumnSecret does, with the context of
+// the query for its keys and the SecretAAD() of the record as associated data when the model is a SecretBinder.
+// Since the columns are scanned in the order of the query, the fields of a SecretBinder are read encrypted and are
+// decrypted by the AfterFind hook of the model once the record is read whole; see decryptSecrets(). Queries of those
+// models must then not skip hooks. The fields of a query that does are left marked as encrypted, which is not valid
+// hex or base64 for the use of the secret, and are refused by Value so that ciphertext is not written back encrypted
+// again.
+type SecretSerializer struct{}
+
+// encryptedMark prefixes a field of a SecretBinder that was read but not yet decrypted. A NUL is not in any secret.
+const encryptedMark = "\x00encrypted:"
+
+// secretAAD returns the associated data of the record, if its model is a SecretBinder
+func secretAAD(dst reflect.Value) []byte {
+	if b, ok := secretBinder(dst); ok {
+		return b.SecretAAD()
+	}
+	return nil
+}
+
+// secretBinder returns the record as a SecretBinder, if its model is one
+func secretBinder(dst reflect.Value) (SecretBinder, bool) {
+	if dst.IsValid() && dst.CanInterface() {
+		b, ok := reflect.Indirect(dst).Interface().(SecretBinder)
+		return b, ok
+	}
+	return nil, false
+}
+
+// Scan reads the value from the database into the field. It is decrypted unless the model is a SecretBinder.
+func (SecretSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var enc string
+	switch v := dbValue.(type) {
+	case nil:
+		return nil
+	case []byte:
+		enc = string(v)
+	case string:
+		enc = v
+	default:
+		return fmt.Errorf("ColumnSecret src unsupported type %T", v)
+	}
+	if _, ok := secretBinder(dst); !ok {
+		dec, err := DecryptColumn(ctx, enc, nil)
+		if err != nil {
+			return fmt.Errorf("%w; unable to decrypt column %s", err, field.DBName)
+		}
+		enc = string(dec)
+	} else {
+		enc = encryptedMark + enc
+	}
+	field.ReflectValueOf(ctx, dst).SetString(enc)
+	return nil
+}
+
+// decryptSecrets decrypts the fields of a SecretBinder record that SecretSerializer read, once the record is read
+// whole. Called by the AfterFind hook of the model.
+func decryptSecrets(tx *gorm.DB, b SecretBinder, fields ...*ColumnSecret) error {
+	aad := b.SecretAAD()
+	for _, f := range fields {
+		if !strings.HasPrefix(string(*f), encryptedMark) {
+			continue
+		}
+		dec, err := DecryptColumn(tx.Statement.Context, strings.TrimPrefix(string(*f), encryptedMark), aad)
+		if err != nil {
+			return fmt.Errorf("%w; unable to decrypt a secret of %q", err, aad)
+		}
+		*f = ColumnSecret(dec)
+	}
+	return nil
+}
+
+// Value encrypts the field to write it to the database
+func (SecretSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	var sec string
+	switch v := fieldValue.(type) {
+	case ColumnSecret:
+		sec = string(v)
+	case *ColumnSecret:
+		if v != nil {
+			sec = string(*v)
+		}
+	case string:
+		sec = v
+	default:
+		return nil, fmt.Errorf("field %s of type %T is not a ColumnSecret", field.Name, v)
+	}
+	if strings.HasPrefix(sec, encryptedMark) {
+		return nil, fmt.Errorf("field %s is still encrypted; was it read by a query that skipped hooks?", field.Name)
+	}
+	return EncryptColumn(ctx, []byte(sec), secretAAD(dst))
+}
@@ -1,7 +1,14 @@
 package model
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 const (
@@ -10,9 +17,71 @@ const (
 	ColumnKeyEnv = "DB_COL_KEY"
 )
 
+// User the database model of a person who may own several Yubi devices
+type User struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	// Email the email address of the user
+	Email string `json:"email"`
+	// Is the user enabled? A disabled user may not validate with any of their devices.
+	IsEnabled bool `json:"is_enabled"`
+	// An admin user has additional capabilities. It can register other users, for instance.
+	IsAdmin bool `json:"is_admin"`
+	// Description info about the user; name, et.al
+	Description string `json:"description"`
+	// DeletedAt when the user was revoked; a revoked user and their devices are kept but no longer found
+	DeletedAt gorm.DeletedAt `json:"revoked_at,omitempty" gorm:"index"`
+	// Devices the Yubi devices of the user. Only filled by Databaser.GetUser().
+	Devices []Device `json:"devices,omitempty" gorm:"foreignKey:UserID"`
+}
+
+// Device the database model of a Yubi device, or rather one of its OTP slots, owned by a User
+type Device struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	// UserID the ID of the owning User
+	UserID uint `json:"user_id" gorm:"index;not null"`
+	// Label tells the devices of a user apart; ex. "primary", "backup"
+	Label string `json:"label"`
+	// Is the device enabled? A lost device is disabled while the user keeps the others.
+	IsEnabled bool `json:"is_enabled"`
+	// Counter the token usage counter. It represents the last counter provided by the Yubi token from a OTP.
+	Counter int64 `json:"counter"`
+	// Session the session usage counter provided by the Yubi token from a OTP. Used to protect against token reuse.
+	Session int64 `json:"session"`
+	// LastTimestamp the token clock value of the last OTP validated
+	LastTimestamp int64 `json:"last_timestamp"`
+	// LastSeen the server time when the last OTP was validated
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	// Public the Yubikey ID assigned to the physical token
+	Public string `json:"public" gorm:"unique;not null"`
+	// Secret the secret AES key associated with the Yubi token slot
+	Secret ColumnSecret `json:"secret,omitempty" gorm:"serializer:secret"`
+	// PrivateID the hex-encoded 6-byte private identity of the Yubi token slot. When set, OTPs must carry it.
+	PrivateID ColumnSecret `json:"private_id,omitempty" gorm:"serializer:secret"`
+	// DeletedAt when the device was revoked; a revoked device is kept, so that its Yubikey ID may not be registered
+	// again, but no longer found
+	DeletedAt gorm.DeletedAt `json:"revoked_at,omitempty" gorm:"index"`
+}
+
+// SecretAAD binds the encrypted columns of the device to its Yubikey ID
+func (d Device) SecretAAD() []byte {
+	return []byte(d.Public)
+}
+
+// AfterFind decrypts the secrets of the device once it is read; see SecretSerializer
+func (d *Device) AfterFind(tx *gorm.DB) error {
+	return decryptSecrets(tx, d, &d.Secret, &d.PrivateID)
+}
+
 // YubiUser the database model to store a Yubi device
+//
+// Deprecated: a YubiUser mixes the user with one device. Use User and Device. Existing YubiUser records are copied
+// to them when the database is opened.
 type YubiUser struct {
-	ID        uint      `json:"-" gorm:"primary_key"`
+	ID        uint      `json:"-" gorm:"primaryKey"`
 	CreatedAt time.Time `json:"created_at,omitempty"`
 	UpdatedAt time.Time `json:"updated_at,omitempty"`
 	// Email the email address of the owner
@@ -25,14 +94,56 @@ type YubiUser struct {
 	Counter int64 `json:"counter"`
 	// Session the session usage counter provided by the Yubi token from a OTP. Used to protect against token reuse.
 	Session int64 `json:"session"`
+	// LastTimestamp the token clock value of the last OTP validated
+	LastTimestamp int64 `json:"last_timestamp"`
+	// LastSeen the server time when the last OTP was validated
+	LastSeen time.Time `json:"last_seen,omitempty"`
 	// Public the Yubikey ID assigned to the physical token
 	Public string `json:"public" gorm:"unique;not null"`
 	// Secret the user's secret AES key associated with the Yubi token slot
-	Secret ColumnSecret `json:"secret,omitempty"`
+	Secret ColumnSecret `json:"secret,omitempty" gorm:"serializer:secret"`
+	// PrivateID the hex-encoded 6-byte private identity of the Yubi token slot. When set, OTPs must carry it.
+	PrivateID ColumnSecret `json:"private_id,omitempty" gorm:"serializer:secret"`
 	// Description info about the owner; email, name, et.al
 	Description string `json:"description"`
 }
 
+// SecretAAD binds the encrypted columns of the record to its Yubikey ID, as for a Device to which it is copied
+func (u YubiUser) SecretAAD() []byte {
+	return []byte(u.Public)
+}
+
+// AfterFind decrypts the secrets of the record once it is read; see SecretSerializer
+func (u *YubiUser) AfterFind(tx *gorm.DB) error {
+	return decryptSecrets(tx, u, &u.Secret, &u.PrivateID)
+}
+
+// PrivateIDSize the size in bytes of the private identity of a Yubikey slot
+const PrivateIDSize = 6
+
+// NormalizePrivateID converts a private ID as the Yubikey Manager shows it, hex with optional spaces, colons or dashes,
+// to the lowercase hex stored in Device.PrivateID. An empty string is returned unchanged.
+func NormalizePrivateID(id string) (string, error) {
+	id = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', ':', '-':
+			return -1
+		}
+		return r
+	}, strings.ToLower(id))
+	if id == "" {
+		return "", nil
+	}
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return "", fmt.Errorf("%w; private ID must be hex", err)
+	}
+	if len(b) != PrivateIDSize {
+		return "", fmt.Errorf("private ID must be %d bytes", PrivateIDSize)
+	}
+	return id, nil
+}
+
 // Editable convert a YubiUser to a struct of values we allow to be edited
 func (u YubiUser) Editable() *YubiUserEditable {
 	return &YubiUserEditable{
@@ -61,3 +172,42 @@ type YubiUserEditable struct {
 	// Description info about the owner; email, name, et.al
 	Description *string `json:"description,omitempty"`
 }
+
+// APIKeySize the size in bytes of a generated API client key, the same as the keys issued by Yubico
+const APIKeySize = 20
+
+// APIClient the database model of a client allowed to use the self-hosted validation server
+type APIClient struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	// ClientID the id the client sends with each request
+	ClientID string `json:"client_id" gorm:"unique;not null"`
+	// Secret the base64-encoded API key used to sign requests and responses with HMAC-SHA1
+	Secret ColumnSecret `json:"secret,omitempty" gorm:"serializer:secret"`
+	// IsEnabled is the client allowed to verify OTPs?
+	IsEnabled bool `json:"is_enabled"`
+	// Owner the email address of the person or team responsible for the client
+	Owner string `json:"owner"`
+	// Description info about the client
+	Description string `json:"description"`
+}
+
+// SecretAAD binds the encrypted API key to the client ID
+func (c APIClient) SecretAAD() []byte {
+	return []byte(c.ClientID)
+}
+
+// AfterFind decrypts the API key of the client once it is read; see SecretSerializer
+func (c *APIClient) AfterFind(tx *gorm.DB) error {
+	return decryptSecrets(tx, c, &c.Secret)
+}
+
+// GenerateAPIKey returns a new random API key, base64-encoded as it is stored in APIClient.Secret
+func GenerateAPIKey() (string, error) {
+	key := make([]byte, APIKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -0,0 +1,96 @@
+package selfhosted
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
+)
+
+// Session reads the token of one user, such as from the input of a terminal, and validates it with the authenticator
+// that created it. A Session may not be used by concurrent goroutines but the sessions of one authenticator may.
+type Session struct {
+	auth    *YubiAuth
+	done    bool
+	token   bytes.Buffer
+	nResets int
+}
+
+// NewSession creates a session that validates the tokens it reads with the authenticator
+func (y *YubiAuth) NewSession() *Session {
+	return &Session{auth: y}
+}
+
+// Token the token read so far
+func (s *Session) Token() string {
+	return s.token.String()
+}
+
+// Bytes the token read so far
+func (s *Session) Bytes() []byte {
+	return s.token.Bytes()
+}
+
+// Public the public part of the token
+func (s *Session) Public() string {
+	if s.token.Len() >= PubLen {
+		return s.token.String()[:PubLen]
+	}
+	return s.token.String()
+}
+
+// Done finished reading the token?
+func (s *Session) Done() bool {
+	return s.done
+}
+
+// Reset make ready to read next token
+func (s *Session) Reset() {
+	s.nResets++
+	s.done = false
+	s.token.Truncate(0)
+}
+
+// GetResetCount returns the number of times Reset() has been called
+func (s *Session) GetResetCount() int {
+	return s.nResets
+}
+
+// ReadTokenData reads bytes from input until a CR is found. Returns true if the token has been fully consumed.
+func (s *Session) ReadTokenData(reader io.Reader) bool {
+	if s.done {
+		s.auth.log().Error("yubi token is already complete")
+		return s.done
+	}
+	_, err := io.Copy(&s.token, reader)
+	if err == nil {
+		l := s.token.Len()
+		if l > 0 && s.token.String()[l-1] == '\r' {
+			s.done = true
+			s.token.Truncate(l - 1) // strip the CR
+			s.auth.log().Debug("read full yubi token")
+		}
+	} else {
+		s.auth.log().WithError(err).Error("unable to taken data")
+	}
+
+	return s.done
+}
+
+// SetToken instead of reading a token from input, set it from a string
+func (s *Session) SetToken(token string) {
+	s.token.Truncate(0)
+	s.token.Write([]byte(token))
+	s.done = true
+}
+
+// Validate validates the token read with YubiAuth.ValidateOTP()
+func (s *Session) Validate() (*model.User, *model.Device, error) {
+	return s.ValidateContext(context.Background())
+}
+
+// ValidateContext is Validate with a context that is passed to every database operation.
+func (s *Session) ValidateContext(ctx context.Context) (*model.User, *model.Device, error) {
+	return s.auth.ValidateOTP(ctx, s.token.String())
+}
@@ -0,0 +1,84 @@
+package selfhosted
+
+import (
+	"time"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+	"github.com/dsggregory/yubiv/pkg/otp"
+	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenClockRate the frequency of the Yubikey timestamp clock, which starts when the key is powered up
+const TokenClockRate = otp.ClockRate // Hz
+
+// TimestampPolicy what to do with an OTP whose token clock disagrees with the server clock
+type TimestampPolicy int
+
+const (
+	// TimestampIgnore does not compare the clocks
+	TimestampIgnore TimestampPolicy = iota
+	// TimestampWarn logs a warning and accepts the OTP
+	TimestampWarn
+	// TimestampReject refuses the OTP with common.DELAYED_OTP
+	TimestampReject
+)
+
+// TimestampCheck settings to detect OTPs that were phished and replayed later, as ykval does. Within one power-up
+// session of the Yubikey (same usage counter), the time elapsed on the token clock between two OTPs should match the
+// time elapsed on the server between their validations. An OTP is delayed when the difference is more than
+// AbsTolerance and more than RelTolerance of the server time elapsed.
+type TimestampCheck struct {
+	Policy TimestampPolicy
+	// AbsTolerance the difference between the clocks that is always allowed
+	AbsTolerance time.Duration
+	// RelTolerance the difference between the clocks allowed as a fraction of the server time elapsed
+	RelTolerance float64
+}
+
+// DefaultTimestampCheck the tolerances of ykval, warning about delayed OTPs
+var DefaultTimestampCheck = TimestampCheck{
+	Policy:       TimestampWarn,
+	AbsTolerance: 20 * time.Second,
+	RelTolerance: 0.3,
+}
+
+// isDelayed compares the clocks since the last OTP of the device, which was validated at device.LastSeen
+func (tc TimestampCheck) isDelayed(device model.Device, token *Token, now time.Time) bool {
+	if device.LastSeen.IsZero() || int64(token.Ctr) != device.Counter {
+		// no previous OTP in this power-up session
+		return false
+	}
+	tokenDelta := time.Duration(int64(token.Timestamp())-device.LastTimestamp) * time.Second / TokenClockRate
+	serverDelta := now.Sub(device.LastSeen)
+	deviation := serverDelta - tokenDelta
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	if deviation <= tc.AbsTolerance {
+		return false
+	}
+	if serverDelta <= 0 {
+		return true
+	}
+	return float64(deviation)/float64(serverDelta) > tc.RelTolerance
+}
+
+// checkTimestamp applies the timestamp policy to a token that otherwise validated
+func (y *YubiAuth) checkTimestamp(device model.Device, token *Token, now time.Time) error {
+	if y.tsCheck.Policy == TimestampIgnore || !y.tsCheck.isDelayed(device, token, now) {
+		return nil
+	}
+	y.log().WithFields(log.Fields{
+		"public":         device.Public,
+		"counter":        token.Ctr,
+		"session":        token.Use,
+		"timestamp":      token.Timestamp(),
+		"last_timestamp": device.LastTimestamp,
+		"last_seen":      device.LastSeen,
+	}).Warn("OTP token clock disagrees with server clock; possibly phished and delayed")
+	if y.tsCheck.Policy == TimestampReject {
+		return common.DELAYED_OTP
+	}
+	return nil
+}
@@ -5,50 +5,37 @@ Yubico servers for validation. See README.md for more detail.
 */
 
 import (
-	"bytes"
-	"crypto/aes"
-	"encoding/binary"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"strings"
 
 	"github.com/dsggregory/yubiv/pkg/common"
+	"github.com/dsggregory/yubiv/pkg/otp"
 
 	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
-	_ "github.com/jinzhu/gorm/dialects/mysql" // need this to load the DB engine
 )
 
 const (
-	UidSize      = 6                 // nolint
+	UidSize      = otp.UIDSize       // nolint
 	PubLen       = common.TokenIDLen // of otp token
-	AesSize      = 16
+	AesSize      = otp.KeySize
 	OtpSize      = common.TokenOTPLen
-	CrcOkResidue = 0xf0b8
-	ModHexMap    = "cbdefghijklnrtuv"
+	CrcOkResidue = otp.CRCOkResidue
+	ModHexMap    = common.ModHex
 )
 
-// Token Yubikey token structure. See https://developers.yubico.com/OTP/OTPs_Explained.html
-type Token struct {
-	// Uid Private secret ID
-	Uid [UidSize]byte // nolint
-	// Ctr Usage counter
-	Ctr uint16
-	// Tstpl timestamp
-	Tstpl uint16
-	// Tstph timestamp hour
-	Tstph uint8
-	// Use Session usage counter
-	Use uint8
-	// Rnd Random number
-	Rnd uint16
-	// Crc checksum of token
-	Crc uint16
-}
+// Token Yubikey token structure. See package otp.
+type Token = otp.Token
 
-// ParseToken generic util to parse a OTP into public-key (yubikey ID) and token
+// ParseToken generic util to parse a OTP into public-key (yubikey ID) and token. The OTP is translated to ModHex from
+// the keyboard layout it was typed in, see common.NormalizeOTP().
 func ParseToken(token string) ([]byte, []byte, error) {
+	token, err := common.NormalizeOTP(token)
+	if err != nil {
+		return nil, nil, err
+	}
 	// check minimal otp length
-	token = strings.TrimSpace(token)
 	tokenLen := len(token)
 	if tokenLen <= OtpSize {
 		return nil, nil, common.BAD_OTP
@@ -71,90 +58,15 @@ func ParseToken(token string) ([]byte, []byte, error) {
 	return pub, otp, nil
 }
 
-func modHexDecode(src []byte) []byte {
-	dst := make([]byte, (len(src)+1)/2)
-	alt := false
-	idx := 0
-
-	for _, val := range src {
-		b := bytes.IndexByte([]byte(ModHexMap), val)
-		if b == -1 {
-			b = 0
-		}
-		bb := byte(b)
-
-		alt = !alt
-		if alt {
-			dst[idx] = bb
-		} else {
-			dst[idx] <<= 4
-			dst[idx] |= bb
-			idx++
-		}
-	}
-	return dst
-}
-
-func crc16(buf []byte) uint16 {
-	mCRC := uint16(0xffff)
-	for _, val := range buf {
-		mCRC ^= uint16(val & 0xff)
-		for i := 0; i < 8; i++ {
-			j := mCRC & 1
-			mCRC >>= 1
-			if j > 0 {
-				mCRC ^= 0x8408
-			}
-		}
-	}
-
-	return mCRC
-}
-
-func extractOtp(buf []byte) (*Token, error) {
-	var token Token
-
-	if len(buf) != 16 || crc16(buf) != CrcOkResidue {
-		return nil, common.CRC_FAILURE
-	}
-
-	copy(token.Uid[:], buf[:6])
-
-	token.Ctr = binary.LittleEndian.Uint16(buf[6:])
-	token.Tstpl = binary.LittleEndian.Uint16(buf[8:])
-
-	token.Tstph = buf[10]
-	token.Use = buf[11]
-
-	token.Rnd = binary.LittleEndian.Uint16(buf[12:])
-	token.Crc = binary.LittleEndian.Uint16(buf[14:])
-
-	return &token, nil
-}
-
-func decipherOtp(otp [OtpSize]byte, key [AesSize]byte) (*Token, error) {
+func decipherOtp(o [OtpSize]byte, key [AesSize]byte) (*Token, error) {
 	// decipher the token using the aes key
-	buf := make([]byte, len(otp))
-	copy(buf, otp[:])
-
-	buf = modHexDecode(buf)
-
-	cipher, _ := aes.NewCipher(key[:])
-	cipher.Decrypt(buf, buf)
-
-	// extract the deciphered token
-	token, err := extractOtp(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	return token, nil
+	return otp.Decrypt(string(o[:]), key[:])
 }
 
 // ShvValidateOTP self-hosted validation of OTP token. Note that `otp` should NOT include the leading public key.
-func ShvValidateOTP(user model.YubiUser, otp []byte) (*Token, error) {
+func ShvValidateOTP(device model.Device, otp []byte) (*Token, error) {
 	// verify the AES128 key
-	priv, err := hex.DecodeString(strings.TrimSpace(string(user.Secret)))
+	priv, err := hex.DecodeString(strings.TrimSpace(string(device.Secret)))
 	if err != nil {
 		return nil, common.BACKEND_ERROR
 	}
@@ -181,12 +93,43 @@ func ShvValidateOTP(user model.YubiUser, otp []byte) (*Token, error) {
 		}
 	}
 
-	// check token validity
-	if token.Ctr < uint16(user.Counter) {
-		return nil, common.REPLAYED_OTP
-	} else if token.Ctr == uint16(user.Counter) && token.Use <= uint8(user.Session) {
-		return nil, common.REPLAYED_OTP
+	if err = CheckPrivateID(device, token); err != nil {
+		return nil, err
+	}
+	if err = CheckCounters(device, token); err != nil {
+		return nil, err
 	}
 
 	return token, nil
 }
+
+// CheckPrivateID returns common.PRIVATE_ID_MISMATCH if the device has a private ID and the decrypted token carries another.
+func CheckPrivateID(device model.Device, token *Token) error {
+	if device.PrivateID == "" {
+		return nil
+	}
+	pid, err := hex.DecodeString(string(device.PrivateID))
+	if err != nil {
+		return common.BACKEND_ERROR
+	}
+	if subtle.ConstantTimeCompare(pid, token.Uid[:]) != 1 {
+		return common.PRIVATE_ID_MISMATCH
+	}
+	return nil
+}
+
+// CheckCounters returns common.REPLAYED_OTP unless the counters of the decrypted token are past those last seen for the device.
+func CheckCounters(device model.Device, token *Token) error {
+	if token.Ctr < uint16(device.Counter) {
+		return common.REPLAYED_OTP
+	} else if token.Ctr == uint16(device.Counter) && token.Use <= uint8(device.Session) {
+		return common.REPLAYED_OTP
+	}
+	return nil
+}
+
+// DecryptOTP deciphers the 32-character `passcode` (without the leading public key) with a 16-byte AES key.
+// It does not check the counters of the token. See CheckCounters() and otp.Decrypt().
+func DecryptOTP(passcode []byte, key []byte) (*Token, error) {
+	return otp.Decrypt(string(passcode), key)
+}
@@ -0,0 +1,33 @@
+package selfhosted
+
+import (
+	"context"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+)
+
+// BackendName the name of the self-hosted database in common.Result.Backend
+const BackendName = "selfhosted"
+
+// validator the common.Validator of a YubiAuth
+type validator struct {
+	auth *YubiAuth
+}
+
+// Validator returns the authenticator as a common.Validator. It validates the OTP it is given, not the token read by
+// the authenticator, so that it may be shared by concurrent requests.
+func (y *YubiAuth) Validator() common.Validator {
+	return validator{auth: y}
+}
+
+// Validate validates the OTP as ValidateContext() does
+func (v validator) Validate(ctx context.Context, otp string) (common.Result, error) {
+	_, _, tok, err := v.auth.validate(ctx, otp)
+	res := common.NewResult(BackendName, otp, err)
+	if tok != nil {
+		res.Counter = uint(tok.Ctr)
+		res.Session = uint(tok.Use)
+		res.Timestamp = uint(tok.Timestamp())
+	}
+	return res, err
+}
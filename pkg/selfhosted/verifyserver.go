@@ -0,0 +1,227 @@
+package selfhosted
+
+/*** A Yubico Validation Protocol 2.0 verify endpoint backed by the self-hosted database. Existing Yubico clients,
+including yubico.YubiClient with WithAPIServers(), may use it in place of YubiCloud.
+See https://developers.yubico.com/yubikey-val/Validation_Protocol_V2.0.html
+*/
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// VerifyPath the path of the verify endpoint on the Yubico servers
+const VerifyPath = "/wsapi/2.0/verify"
+
+var nonceRe = regexp.MustCompile(`^[a-zA-Z0-9]{16,40}$`)
+
+// KeyStore provides the API key of each validation client. The key is used to check request signatures and to sign
+// responses. APIKey returns common.NO_SUCH_CLIENT when the id is unknown and common.OPERATION_NOT_ALLOWED when the
+// client may not verify OTPs.
+type KeyStore interface {
+	APIKey(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticKeys a KeyStore that maps client id to its non-encoded API key
+type StaticKeys map[string][]byte
+
+// APIKey returns the API key of the client `id`
+func (k StaticKeys) APIKey(_ context.Context, id string) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, common.NO_SUCH_CLIENT
+	}
+	return key, nil
+}
+
+// dbKeys a KeyStore of the API clients registered in the database
+type dbKeys struct {
+	db yubidb.Databaser
+}
+
+// DatabaseKeys returns a KeyStore of the API clients registered in db. A client that is not enabled gets
+// common.OPERATION_NOT_ALLOWED.
+func DatabaseKeys(db yubidb.Databaser) KeyStore {
+	return dbKeys{db: db}
+}
+
+// APIKey returns the decoded API key of the enabled client `id`
+func (k dbKeys) APIKey(ctx context.Context, id string) ([]byte, error) {
+	client, err := k.db.GetClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !client.IsEnabled {
+		return nil, common.OPERATION_NOT_ALLOWED
+	}
+	key, err := base64.StdEncoding.DecodeString(string(client.Secret))
+	if err != nil {
+		return nil, fmt.Errorf("%w; API key of client %s is not base64", err, id)
+	}
+	return key, nil
+}
+
+// VerifyHandler an http.Handler that serves the verify endpoint of the Validation Protocol 2.0. Mount it at VerifyPath.
+type VerifyHandler struct {
+	auth *YubiAuth
+	keys KeyStore
+	// mu protects lastRequest
+	mu sync.Mutex
+	// lastRequest the otp and nonce of the last request that validated, by Yubikey ID, to detect REPLAYED_REQUEST
+	lastRequest map[string]string
+}
+
+// NewVerifyHandler creates a verify endpoint that validates OTPs with `auth`, which must have a database, and signs
+// responses with the client API keys in `keys`.
+func NewVerifyHandler(auth *YubiAuth, keys KeyStore) *VerifyHandler {
+	return &VerifyHandler{
+		auth:        auth,
+		keys:        keys,
+		lastRequest: make(map[string]string),
+	}
+}
+
+// protocolStatus maps a validation error to the status the protocol reports to clients
+func protocolStatus(err error) common.Status {
+	switch status := common.StatusOf(err); status {
+	case common.OK, common.REPLAYED_OTP, common.BACKEND_ERROR:
+		return status
+	case common.UNREGISTERED_USER, common.CRC_FAILURE, common.EMPTY_YUBI_TOKEN, common.BAD_OTP, common.PRIVATE_ID_MISMATCH,
+		common.DELAYED_OTP:
+		return common.BAD_OTP
+	default:
+		return common.BACKEND_ERROR
+	}
+}
+
+// protocolTime formats t as the Yubico servers do; UTC with a "Z0" suffix followed by milliseconds
+func protocolTime(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%s%03d", t.Format("2006-01-02T15:04:05Z0"), t.Nanosecond()/int(time.Millisecond))
+}
+
+// writeResponse writes the response parameters, signed with key if it is not nil
+func writeResponse(w http.ResponseWriter, m map[string]string, key []byte) {
+	m["t"] = protocolTime(time.Now())
+	if key != nil {
+		m["h"] = base64.StdEncoding.EncodeToString(common.Signature(m, key))
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	// the order used by the Yubico servers
+	for _, k := range []string{"h", "t", "otp", "nonce", "sl", "timestamp", "sessioncounter", "sessionuse", "status"} {
+		if v, ok := m[k]; ok {
+			_, _ = fmt.Fprintf(w, "%s=%s\r\n", k, v)
+		}
+	}
+}
+
+// isValidRequestHash checks the optional request signature
+func isValidRequestHash(m map[string]string, key []byte) bool {
+	if m["h"] == "" {
+		return true
+	}
+	exp, err := base64.StdEncoding.DecodeString(m["h"])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(exp, common.Signature(m, key))
+}
+
+func (h *VerifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeResponse(w, map[string]string{"status": common.MISSING_PARAMETER.String()}, nil)
+		return
+	}
+	req := make(map[string]string)
+	for k := range r.Form {
+		req[k] = r.Form.Get(k)
+	}
+	otp := strings.TrimSpace(req["otp"])
+	resp := map[string]string{
+		"otp":   otp,
+		"nonce": req["nonce"],
+	}
+	logger := h.auth.log().WithFields(log.Fields{"id": req["id"], "otp": otp})
+
+	if req["id"] == "" {
+		resp["status"] = common.MISSING_PARAMETER.String()
+		writeResponse(w, resp, nil)
+		return
+	}
+	key, err := h.keys.APIKey(r.Context(), req["id"])
+	if err != nil {
+		var status common.Status
+		if !errors.As(err, &status) || (status != common.NO_SUCH_CLIENT && status != common.OPERATION_NOT_ALLOWED) {
+			logger.WithError(err).Error("unable to look up API client")
+			status = common.BACKEND_ERROR
+		}
+		resp["status"] = status.String()
+		writeResponse(w, resp, nil)
+		return
+	}
+
+	if !isValidRequestHash(req, key) {
+		resp["status"] = common.BAD_SIGNATURE.String()
+		writeResponse(w, resp, key)
+		return
+	}
+	if otp == "" || !nonceRe.MatchString(req["nonce"]) {
+		resp["status"] = common.MISSING_PARAMETER.String()
+		writeResponse(w, resp, key)
+		return
+	}
+	if _, ok := req["sl"]; ok {
+		// there are no other servers to sync with
+		resp["sl"] = "100"
+	}
+
+	if h.auth.db == nil {
+		logger.Error("verify endpoint requires a self-hosted database")
+		resp["status"] = common.BACKEND_ERROR.String()
+		writeResponse(w, resp, key)
+		return
+	}
+	_, device, tok, err := h.auth.validate(r.Context(), otp)
+	status := protocolStatus(err)
+	if status == common.REPLAYED_OTP && device != nil && h.isLastRequest(device.Public, otp, req["nonce"]) {
+		status = common.REPLAYED_REQUEST
+	}
+	if err != nil {
+		logger.WithError(err).WithField("status", status).Debug("OTP did not validate")
+	}
+	if status == common.OK {
+		h.setLastRequest(device.Public, otp, req["nonce"])
+		if req["timestamp"] == "1" {
+			resp["timestamp"] = fmt.Sprintf("%d", tok.Timestamp())
+			resp["sessioncounter"] = fmt.Sprintf("%d", tok.Ctr)
+			resp["sessionuse"] = fmt.Sprintf("%d", tok.Use)
+		}
+	}
+	resp["status"] = status.String()
+	writeResponse(w, resp, key)
+}
+
+func (h *VerifyHandler) isLastRequest(public string, otp string, nonce string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastRequest[public] == otp+nonce
+}
+
+func (h *VerifyHandler) setLastRequest(public string, otp string, nonce string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRequest[public] = otp + nonce
+}
@@ -2,17 +2,38 @@ package selfhosted
 
 import (
 	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dsggregory/yubiv/pkg/common"
+	"github.com/dsggregory/yubiv/pkg/otp"
+	"github.com/dsggregory/yubiv/pkg/yubico"
 
 	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
+	"github.com/dsggregory/yubiv/pkg/selfhosted/keyprovider"
 	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
 	yubitest "github.com/dsggregory/yubiv/pkg/test"
 	. "gopkg.in/check.v1"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func Test(t *testing.T) {
@@ -31,25 +52,57 @@ func (s *YubiSuite) SetUpTest(c *C) {
 }
 
 func (s *YubiSuite) TestReadToken(c *C) {
-	y, err := NewYubiAuth("")
+	y, err := NewYubiAuth()
 	c.Assert(err, Equals, nil)
 	rdr := strings.NewReader(yubitest.TestTokens[0].Token(0))
 	b := y.ReadTokenData(rdr)
 	c.Assert(b, Equals, false)
-	c.Assert(y.done, Equals, false)
+	c.Assert(y.Done(), Equals, false)
 	c.Assert(y.Token(), Equals, yubitest.TestTokens[0].Token(0))
 	b = y.ReadTokenData(strings.NewReader("\r"))
 	c.Assert(b, Equals, true) // done
-	c.Assert(y.done, Equals, true)
+	c.Assert(y.Done(), Equals, true)
 	c.Assert(y.Token(), Equals, yubitest.TestTokens[0].Token(0))
 	y.ReadTokenData(strings.NewReader("should not be added since done"))
-	c.Assert(y.done, Equals, true)
+	c.Assert(y.Done(), Equals, true)
 	c.Assert(y.Token(), Equals, yubitest.TestTokens[0].Token(0))
 }
 
-func (s *YubiSuite) readUser() *model.YubiUser {
-	user, _ := s.db.Get(yubitest.TestTokens[0].Pub[:PubLen])
-	return user
+func (s *YubiSuite) TestSession(c *C) {
+	y := s.newYubiAuth(c)
+	s1, s2 := y.NewSession(), y.NewSession()
+	s1.ReadTokenData(strings.NewReader(yubitest.TestTokens[0].Token(0)))
+	s2.SetToken(yubitest.TestTokens[1].Token(0))
+	c.Assert(s1.Done(), Equals, false)
+	c.Assert(s2.Public(), Equals, yubitest.TestTokens[1].Pub)
+	c.Assert(s1.ReadTokenData(strings.NewReader("\r")), Equals, true)
+
+	_, device, err := s1.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(device.Public, Equals, yubitest.TestTokens[0].Pub)
+	_, device, err = s2.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(device.Public, Equals, yubitest.TestTokens[1].Pub)
+	c.Assert(y.Token(), Equals, "")
+
+	s1.Reset()
+	c.Assert(s1.Done(), Equals, false)
+	c.Assert(s1.GetResetCount(), Equals, 1)
+	s1.SetToken(yubitest.TestTokens[0].Token(0))
+	_, _, err = s1.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+}
+
+// newYubiAuth creates an authenticator of the suite's database
+func (s *YubiSuite) newYubiAuth(c *C, options ...func(y *YubiAuth)) *YubiAuth {
+	y, err := NewYubiAuth(append([]func(y *YubiAuth){WithDatabase(s.db)}, options...)...)
+	c.Assert(err, IsNil)
+	return y
+}
+
+func (s *YubiSuite) readDevice() *model.Device {
+	device, _ := s.db.GetDevice(context.Background(), yubitest.TestTokens[0].Pub[:PubLen])
+	return device
 }
 
 func (s *YubiSuite) TestShvValidateOTP(c *C) {
@@ -58,43 +111,917 @@ func (s *YubiSuite) TestShvValidateOTP(c *C) {
 
 	otp = yubitest.TestTokens[0].OTPs[0]
 	secret = yubitest.TestTokens[0].Secret
-	user := model.YubiUser{Secret: model.ColumnSecret(secret)}
-	tok, err := ShvValidateOTP(user, []byte(otp))
+	device := model.Device{Secret: model.ColumnSecret(secret)}
+	tok, err := ShvValidateOTP(device, []byte(otp))
 	c.Assert(err, IsNil)
 	c.Assert(tok, NotNil)
 }
 
 func (s *YubiSuite) TestSelfHosted(c *C) {
-	y, err := NewYubiAuth("")
+	y, err := NewYubiAuth(WithDatabase(s.db))
 	c.Assert(err, Equals, nil)
-	y.db = s.db
 	y.SetToken(yubitest.TestTokens[0].Token(0))
-	_, err = y.Validate()
+	_, _, err = y.Validate()
 	c.Assert(err, Equals, nil)
-	user := s.readUser()
-	c.Assert(user.Session, Equals, int64(1))
+	device := s.readDevice()
+	c.Assert(device.Session, Equals, int64(1))
 
 	// validating the same token should fail
-	_, err = y.Validate()
+	_, _, err = y.Validate()
 	c.Assert(err, NotNil)
-	c.Assert(err, Equals, common.REPLAYED_OTP)
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
 
 	// validating a subsequent token should succeed
 	y.SetToken(yubitest.TestTokens[0].Token(1))
-	_, err = y.Validate()
+	_, _, err = y.Validate()
 	c.Assert(err, IsNil)
-	user = s.readUser()
-	c.Assert(user.Session, Equals, int64(2))
+	device = s.readDevice()
+	c.Assert(device.Session, Equals, int64(2))
 
 	// validating an unknown yubikey's token - yubikey not in DB
-	y.SetToken("ccccccj0000000000000000000000000000000000000")
-	_, err = y.Validate()
+	y.SetToken("ccccccjccccccccccccccccccccccccccccccccccccc")
+	_, _, err = y.Validate()
 	c.Assert(err, NotNil)
 	c.Assert(strings.Contains(err.Error(), common.UNREGISTERED_USER.String()), Equals, true)
+	c.Assert(err, yubitest.ErrorIs, common.UNREGISTERED_USER)
+	c.Assert(errors.Is(err, yubidb.ErrNotFound), Equals, true)
+	var verr *common.ValidationError
+	c.Assert(errors.As(err, &verr), Equals, true)
+	c.Assert(verr.YubikeyID, Equals, "ccccccjccccc")
+	c.Assert(common.StatusOf(err), Equals, common.UNREGISTERED_USER)
+}
+
+func (s *YubiSuite) TestKeyboardLayouts(c *C) {
+	ctx := context.Background()
+	y := s.newYubiAuth(c)
+	tt := yubitest.TestTokens[0]
+
+	// the OTP as typed on hosts of other layouts
+	for i, otp := range []string{
+		common.LayoutDvorak.FromModHex(tt.Token(0)),
+		common.LayoutColemak.FromModHex(tt.Token(1)),
+		strings.ToUpper(tt.Token(2)), // caps lock
+		" " + tt.Token(3) + "\n",
+	} {
+		_, device, err := y.ValidateOTP(ctx, otp)
+		c.Assert(err, IsNil, Commentf("OTP %d %s", i, otp))
+		c.Assert(device.Public, Equals, tt.Pub)
+	}
+	pub, _, err := ParseToken(common.LayoutDvorak.FromModHex(tt.Token(4)))
+	c.Assert(err, IsNil)
+	c.Assert(string(pub), Equals, tt.Pub)
+
+	// not ModHex in any layout; rejected before it is deciphered
+	otp := tt.Token(4)
+	_, _, err = y.ValidateOTP(ctx, otp[:len(otp)-1]+"z")
+	c.Assert(err, yubitest.ErrorIs, common.BAD_OTP)
+	device, err := s.db.GetDevice(ctx, tt.Pub)
+	c.Assert(err, IsNil)
+	_, err = ShvValidateOTP(*device, []byte(otp[PubLen:len(otp)-1]+"z"))
+	c.Assert(err, yubitest.ErrorIs, common.BAD_OTP)
+	_, _, err = ParseToken(otp[:len(otp)-1] + "z")
+	c.Assert(err, yubitest.ErrorIs, common.BAD_OTP)
+	_, _, err = y.ValidateOTP(ctx, otp)
+	c.Assert(err, IsNil)
+}
+
+func (s *YubiSuite) TestGenerator(c *C) {
+	ctx := context.Background()
+	key, uid := make([]byte, otp.KeySize), []byte{1, 2, 3, 4, 5, 6}
+	_, _ = rand.Read(key)
+	g, err := otp.NewGenerator("cccccccccccb", uid, key)
+	c.Assert(err, IsNil)
+	user, err := s.db.AddUser(ctx, model.User{IsEnabled: true, Email: "soft@domain.com"})
+	c.Assert(err, IsNil)
+	c.Assert(s.db.AddDevice(ctx, model.Device{UserID: user.ID, IsEnabled: true, Public: "cccccccccccb",
+		Secret: model.ColumnSecret(hex.EncodeToString(key)), PrivateID: model.ColumnSecret(hex.EncodeToString(uid))}), IsNil)
+
+	y := s.newYubiAuth(c)
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			c.Assert(g.PowerUp(), IsNil)
+		}
+		o, err := g.OTP()
+		c.Assert(err, IsNil)
+		_, _, err = y.ValidateOTP(ctx, o)
+		c.Assert(err, IsNil)
+		_, _, err = y.ValidateOTP(ctx, o)
+		c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+	}
+}
+
+func (s *YubiSuite) TestAmbiguousLayout(c *C) {
+	ctx := context.Background()
+	key := []byte("0123456789abcdef")
+	g, err := otp.NewGenerator("cccccccccccb", []byte{1, 2, 3, 4, 5, 6}, key)
+	c.Assert(err, IsNil)
+	user, err := s.db.AddUser(ctx, model.User{IsEnabled: true, Email: "soft@domain.com"})
+	c.Assert(err, IsNil)
+	c.Assert(s.db.AddDevice(ctx, model.Device{UserID: user.ID, IsEnabled: true, Public: "cccccccccccb",
+		Secret: model.ColumnSecret(hex.EncodeToString(key))}), IsNil)
+
+	// an OTP typed on Colemak whose characters are all ModHex, as about one in 70 are
+	var colemak string
+	for i := 0; i < 2000 && colemak == ""; i++ {
+		o, err := g.OTP()
+		c.Assert(err, IsNil)
+		if typed := common.LayoutColemak.FromModHex(o); common.IsModHex(typed) {
+			colemak = typed
+		}
+	}
+	c.Assert(colemak, Not(Equals), "")
+	candidates, err := common.OTPCandidates(colemak)
+	c.Assert(err, IsNil)
+	c.Assert(candidates, HasLen, 2)
+	c.Assert(candidates[0], Equals, colemak)
+
+	// taken as QWERTY it fails the CRC, as Colemak it validates
+	y := s.newYubiAuth(c)
+	_, device, err := y.ValidateOTP(ctx, colemak)
+	c.Assert(err, IsNil)
+	c.Assert(device.Public, Equals, "cccccccccccb")
+	_, _, err = y.ValidateOTP(ctx, colemak)
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+}
+
+func (s *YubiSuite) TestVerifyHandler(c *C) {
+	apiKey := []byte("0123456789abcdef0123")
+	y, err := NewYubiAuth(WithDatabase(s.db))
+	c.Assert(err, IsNil)
+	mux := http.NewServeMux()
+	mux.Handle(VerifyPath, NewVerifyHandler(y, StaticKeys{"42": apiKey}))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	yc, err := yubico.NewYubiClient(
+		yubico.WithAPIServers([]string{ts.URL + VerifyPath}),
+		yubico.WithAPICreds("42", base64.StdEncoding.EncodeToString(apiKey)),
+	)
+	c.Assert(err, IsNil)
+
+	res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.OK)
+	c.Assert(res.SessionUse, Equals, uint(1))
+	c.Assert(res.SL, Equals, 100)
+
+	res, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, NotNil)
+	c.Assert(res.Status, Equals, common.REPLAYED_OTP)
+
+	// same OTP and nonce as the request that validated
+	req := yubico.VerifyRequest{OTP: yubitest.TestTokens[0].Token(1), Nonce: "0123456789abcdef"}
+	res, err = yc.Verify(&req)
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.OK)
+	res, err = yc.Verify(&req)
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.REPLAYED_REQUEST)
+
+	res, err = yc.VerifyOTP("ccccccjccccccccccccccccccccccccccccccccccccc")
+	c.Assert(err, NotNil)
+	c.Assert(res.Status, Equals, common.BAD_OTP)
+
+	// a client whose key does not match the server's cannot trust the response
+	bad, err := yubico.NewYubiClient(
+		yubico.WithAPIServers([]string{ts.URL + VerifyPath}),
+		yubico.WithAPICreds("42", base64.StdEncoding.EncodeToString([]byte("wrong"))),
+	)
+	c.Assert(err, IsNil)
+	_, err = bad.VerifyOTP(yubitest.TestTokens[0].Token(2))
+	c.Assert(err, NotNil)
+
+	// raw protocol responses
+	get := func(q url.Values) string {
+		resp, err := http.Get(ts.URL + VerifyPath + "?" + q.Encode())
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(b)
+	}
+	c.Assert(strings.Contains(get(url.Values{"otp": {"x"}}), "status=MISSING_PARAMETER"), Equals, true)
+	c.Assert(strings.Contains(get(url.Values{"id": {"7"}, "otp": {"x"}, "nonce": {"0123456789abcdef"}}),
+		"status=NO_SUCH_CLIENT"), Equals, true)
+	c.Assert(strings.Contains(get(url.Values{"id": {"42"}, "otp": {"x"}, "nonce": {"short"}}),
+		"status=MISSING_PARAMETER"), Equals, true)
+	c.Assert(strings.Contains(get(url.Values{"id": {"42"}, "otp": {"x"}, "nonce": {"0123456789abcdef"}, "h": {"Zm9v"}}),
+		"status=BAD_SIGNATURE"), Equals, true)
+}
+
+func (s *YubiSuite) TestDatabaseKeys(c *C) {
+	ctx := context.Background()
+	secret, err := model.GenerateAPIKey()
+	c.Assert(err, IsNil)
+	c.Assert(s.db.AddClient(ctx, model.APIClient{ClientID: "1", Secret: model.ColumnSecret(secret), IsEnabled: true, Owner: "ops@domain.com"}), IsNil)
+	c.Assert(s.db.AddClient(ctx, model.APIClient{ClientID: "2", Secret: model.ColumnSecret(secret)}), IsNil)
+
+	keys := DatabaseKeys(s.db)
+	key, err := keys.APIKey(ctx, "1")
+	c.Assert(err, IsNil)
+	c.Assert(len(key), Equals, model.APIKeySize)
+	_, err = keys.APIKey(ctx, "2")
+	c.Assert(err, yubitest.ErrorIs, common.OPERATION_NOT_ALLOWED)
+	_, err = keys.APIKey(ctx, "3")
+	c.Assert(err, yubitest.ErrorIs, common.NO_SUCH_CLIENT)
+
+	ts := httptest.NewServer(NewVerifyHandler(s.newYubiAuth(c), keys))
+	defer ts.Close()
+	yc, err := yubico.NewYubiClient(yubico.WithAPIServers([]string{ts.URL}), yubico.WithAPICreds("2", secret))
+	c.Assert(err, IsNil)
+	res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, NotNil)
+	c.Assert(res.Status, Equals, common.OPERATION_NOT_ALLOWED)
+
+	// enabling the client allows it to verify
+	c.Assert(s.db.UpdateClient(ctx, model.APIClient{ClientID: "2", IsEnabled: true}), IsNil)
+	res, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.OK)
+}
+
+func (s *YubiSuite) TestPrivateID(c *C) {
+	ctx := context.Background()
+	tt := yubitest.TestTokens[1]
+	key, _ := hex.DecodeString(tt.Secret)
+	tok, err := DecryptOTP([]byte(tt.OTPs[0]), key)
+	c.Assert(err, IsNil)
+
+	// as the Yubikey Manager shows it
+	s.db = yubitest.MapDbFromTestTokensWith(func(i int, device *model.Device) {
+		if device.Public == tt.Pub {
+			device.PrivateID = model.ColumnSecret(strings.ToUpper(fmt.Sprintf("% x", tok.Uid[:])))
+		}
+	})
+	device, err := s.db.GetDevice(ctx, tt.Pub)
+	c.Assert(err, IsNil)
+	c.Assert(string(device.PrivateID), Equals, hex.EncodeToString(tok.Uid[:]))
+
+	y := s.newYubiAuth(c)
+	y.SetToken(tt.Token(0))
+	_, _, err = y.Validate()
+	c.Assert(err, IsNil)
+
+	// an OTP minted with the right AES key but another private ID
+	s.db = yubitest.MapDbFromTestTokensWith(func(i int, device *model.Device) {
+		if device.Public == tt.Pub {
+			device.PrivateID = "010203040506"
+		}
+	})
+	y = s.newYubiAuth(c)
+	y.SetToken(tt.Token(1))
+	_, _, err = y.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.PRIVATE_ID_MISMATCH)
+
+	err = s.db.AddDevice(ctx, model.Device{UserID: device.UserID, Public: "ccccccccbbbb", PrivateID: "0102"})
+	c.Assert(err, NotNil)
+}
+
+// validateConcurrently validates the same OTP from many goroutines and returns the number that succeeded
+func validateConcurrently(c *C, db yubidb.Databaser, otp string) int {
+	const n = 20
+	var wg sync.WaitGroup
+	var ok int32
+	start := make(chan struct{})
+	// one authenticator serves every goroutine
+	y, err := NewYubiAuth(WithDatabase(db))
+	c.Assert(err, IsNil)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, _, err := y.ValidateOTP(context.Background(), otp)
+			if err == nil {
+				atomic.AddInt32(&ok, 1)
+			} else {
+				c.Check(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return int(ok)
+}
+
+func (s *YubiSuite) TestConcurrentReplay(c *C) {
+	c.Assert(validateConcurrently(c, s.db, yubitest.TestTokens[0].Token(0)), Equals, 1)
+	c.Assert(validateConcurrently(c, s.db, yubitest.TestTokens[0].Token(1)), Equals, 1)
+	c.Assert(s.readDevice().Session, Equals, int64(2))
+
+	db, err := yubidb.NewDb("file://" + filepath.Join(c.MkDir(), "yubi.db") + "?_busy_timeout=10000")
+	c.Assert(err, IsNil)
+	db.SetSecretColumnKeyFunc(func() string { return "test key" })
+	tt := yubitest.TestTokens[1]
+	user, err := db.AddUser(context.Background(), model.User{IsEnabled: true, Email: "test@domain.com"})
+	c.Assert(err, IsNil)
+	c.Assert(db.AddDevice(context.Background(),
+		model.Device{UserID: user.ID, IsEnabled: true, Public: tt.Pub, Secret: model.ColumnSecret(tt.Secret)}), IsNil)
+	c.Assert(validateConcurrently(c, db, tt.Token(0)), Equals, 1)
+	device, err := db.GetDevice(context.Background(), tt.Pub)
+	c.Assert(err, IsNil)
+	c.Assert(device.Session, Equals, int64(1))
+}
+
+func (s *YubiSuite) TestMultipleDevices(c *C) {
+	ctx := context.Background()
+	s.db = yubidb.NewMapDb()
+	user, err := s.db.AddUser(ctx, model.User{Email: "two@domain.com", IsEnabled: true})
+	c.Assert(err, IsNil)
+	for i, label := range []string{"primary", "backup"} {
+		tt := yubitest.TestTokens[3+i]
+		c.Assert(s.db.AddDevice(ctx, model.Device{
+			UserID: user.ID, Label: label, IsEnabled: true, Public: tt.Pub, Secret: model.ColumnSecret(tt.Secret),
+		}), IsNil)
+	}
+	u, err := s.db.GetUser(ctx, user.ID)
+	c.Assert(err, IsNil)
+	c.Assert(len(u.Devices), Equals, 2)
+	// a Yubikey ID is registered once
+	c.Assert(s.db.AddDevice(ctx, model.Device{UserID: user.ID, Public: yubitest.TestTokens[3].Pub}), NotNil)
+
+	y := s.newYubiAuth(c)
+	for i, label := range []string{"primary", "backup"} {
+		y.SetToken(yubitest.TestTokens[3+i].Token(0))
+		vu, vd, err := y.Validate()
+		c.Assert(err, IsNil)
+		c.Assert(vu.Email, Equals, "two@domain.com")
+		c.Assert(vd.Label, Equals, label)
+	}
+
+	// a lost device is disabled while the other one still validates
+	d, err := s.db.GetDevice(ctx, yubitest.TestTokens[3].Pub)
+	c.Assert(err, IsNil)
+	d.IsEnabled = false
+	c.Assert(s.db.UpdateDevice(ctx, *d), IsNil)
+	y.SetToken(yubitest.TestTokens[3].Token(1))
+	_, _, err = y.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.UNREGISTERED_USER)
+	y.SetToken(yubitest.TestTokens[4].Token(1))
+	_, _, err = y.Validate()
+	c.Assert(err, IsNil)
+
+	// a disabled user may not use any device
+	u.IsEnabled = false
+	c.Assert(s.db.UpdateUser(ctx, *u), IsNil)
+	y.SetToken(yubitest.TestTokens[4].Token(2))
+	_, _, err = y.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.UNREGISTERED_USER)
+
+	c.Assert(s.db.AddDevice(ctx, model.Device{UserID: 999, Public: "cccccccccccc"}), NotNil)
+}
+
+// testLifecycle exercises the user and device management of an empty database
+func testLifecycle(c *C, db yubidb.Databaser) {
+	ctx := context.Background()
+	yes, no := true, false
+	for i := 0; i < 25; i++ {
+		u, err := db.AddUser(ctx, model.User{
+			Email: fmt.Sprintf("user%02d@domain.com", i), IsEnabled: i%5 != 0, IsAdmin: i == 7, Description: "staff",
+		})
+		c.Assert(err, IsNil)
+		c.Assert(db.AddDevice(ctx, model.Device{
+			UserID: u.ID, Label: "primary", IsEnabled: true, Public: fmt.Sprintf("cccccccc%04d", i),
+		}), IsNil)
+	}
+
+	u, err := db.GetUserByEmail(ctx, "user07@domain.com")
+	c.Assert(err, IsNil)
+	c.Assert(u.IsAdmin, Equals, true)
+	_, err = db.GetUserByEmail(ctx, "nobody@domain.com")
+	c.Assert(err, Equals, yubidb.ErrNotFound)
+
+	// paging
+	page, err := db.ListUsers(ctx, yubidb.UserFilter{Offset: 10, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(len(page), Equals, 10)
+	c.Assert(page[0].Email, Equals, "user10@domain.com")
+	page, err = db.ListUsers(ctx, yubidb.UserFilter{Offset: 20, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(len(page), Equals, 5)
+	n, err := db.CountUsers(ctx, yubidb.UserFilter{Offset: 20, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 25)
+
+	// filters
+	n, err = db.CountUsers(ctx, yubidb.UserFilter{IsEnabled: &no})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 5)
+	page, err = db.ListUsers(ctx, yubidb.UserFilter{Search: "USER1", IsEnabled: &yes})
+	c.Assert(err, IsNil)
+	c.Assert(len(page), Equals, 8)
+	n, err = db.CountUsers(ctx, yubidb.UserFilter{IsAdmin: &yes})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	devices, err := db.ListDevices(ctx, yubidb.DeviceFilter{Search: "cccccccc002", Limit: 3})
+	c.Assert(err, IsNil)
+	c.Assert(len(devices), Equals, 3)
+	c.Assert(devices[0].Public, Equals, "cccccccc0020")
+	n, err = db.CountDevices(ctx, yubidb.DeviceFilter{UserID: u.ID})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// revoked users and their devices are kept but not found
+	c.Assert(db.RevokeUser(ctx, u.ID), IsNil)
+	_, err = db.GetUser(ctx, u.ID)
+	c.Assert(err, Equals, yubidb.ErrNotFound)
+	_, err = db.GetDevice(ctx, "cccccccc0007")
+	c.Assert(err, NotNil)
+	n, err = db.CountUsers(ctx, yubidb.UserFilter{})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 24)
+	n, err = db.CountDevices(ctx, yubidb.DeviceFilter{IncludeRevoked: true})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 25)
+	c.Assert(db.RevokeUser(ctx, u.ID), Equals, yubidb.ErrNotFound)
+
+	c.Assert(db.RevokeDevice(ctx, "cccccccc0008"), IsNil)
+	_, err = db.GetDevice(ctx, "cccccccc0008")
+	c.Assert(err, NotNil)
+	// the Yubikey ID of a revoked device may not be registered again until it is deleted
+	u8, err := db.GetUserByEmail(ctx, "user08@domain.com")
+	c.Assert(err, IsNil)
+	c.Assert(db.AddDevice(ctx, model.Device{UserID: u8.ID, Public: "cccccccc0008"}), NotNil)
+	c.Assert(db.DeleteDevice(ctx, "cccccccc0008"), IsNil)
+	c.Assert(db.AddDevice(ctx, model.Device{UserID: u8.ID, Public: "cccccccc0008"}), IsNil)
+
+	c.Assert(db.DeleteUser(ctx, u8.ID), IsNil)
+	_, err = db.GetDevice(ctx, "cccccccc0008")
+	c.Assert(err, NotNil)
+	n, err = db.CountDevices(ctx, yubidb.DeviceFilter{IncludeRevoked: true})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 24)
+	c.Assert(db.DeleteUser(ctx, u8.ID), Equals, yubidb.ErrNotFound)
+	c.Assert(db.DeleteDevice(ctx, "cccccccc0008"), Equals, yubidb.ErrNotFound)
+	c.Assert(db.UpdateUser(ctx, model.User{ID: u8.ID, IsEnabled: true}), Equals, yubidb.ErrNotFound)
+	c.Assert(db.UpdateDevice(ctx, model.Device{Public: "cccccccc0008", IsEnabled: true}), Equals, yubidb.ErrNotFound)
+
+	// clients
+	c.Assert(db.AddClient(ctx, model.APIClient{ClientID: "1", Secret: "api key", Owner: "ops@domain.com"}), IsNil)
+	c.Assert(db.AddClient(ctx, model.APIClient{ClientID: "1", Secret: "other key"}), NotNil)
+	client, err := db.GetClient(ctx, "1")
+	c.Assert(err, IsNil)
+	c.Assert(client.Owner, Equals, "ops@domain.com")
+	c.Assert(db.UpdateClient(ctx, model.APIClient{ClientID: "1", IsEnabled: true}), IsNil)
+	c.Assert(db.UpdateClient(ctx, model.APIClient{ClientID: "2", IsEnabled: true}), yubitest.ErrorIs, common.NO_SUCH_CLIENT)
+}
+
+func (s *YubiSuite) TestLifecycle(c *C) {
+	testLifecycle(c, yubidb.NewMapDb())
+
+	db, err := yubidb.NewDb("file://" + filepath.Join(c.MkDir(), "yubi.db"))
+	c.Assert(err, IsNil)
+	db.SetSecretColumnKeyFunc(func() string { return "test key" })
+	testLifecycle(c, db)
+}
+
+func (s *YubiSuite) TestNewDb(c *C) {
+	_, err := yubidb.NewDb("mongodb://localhost/yubi")
+	c.Assert(err, ErrorMatches, `unsupported database scheme "mongodb"`)
+
+	// reaches the postgres driver, which cannot connect
+	for _, scheme := range []string{"postgres", "postgresql"} {
+		_, err = yubidb.NewDb(scheme + "://user:pass@127.0.0.1:1/yubi?sslmode=disable&connect_timeout=1")
+		c.Assert(err, NotNil)
+		c.Assert(strings.Contains(err.Error(), "unsupported"), Equals, false)
+	}
+	// the DSN of the mysql driver has no scheme and reaches mysql, which cannot connect
+	_, err = yubidb.NewDb("user:pass@tcp(127.0.0.1:1)/yubi?timeout=1s")
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "unsupported"), Equals, false)
+}
+
+func (s *YubiSuite) TestSchemaMigrations(c *C) {
+	for _, dialect := range []string{"sqlite", "mysql", "postgres"} {
+		migrations, err := yubidb.Migrations(dialect)
+		c.Assert(err, IsNil)
+		c.Assert(len(migrations) > 0, Equals, true)
+		for _, m := range migrations {
+			c.Assert(len(m.Statements()) > 0, Equals, true, Commentf("%s %d", dialect, m.Version))
+		}
+		c.Assert(migrations[1].Requires, DeepEquals, []string{"yubi_users"})
+	}
+	_, err := yubidb.Migrations("mssql")
+	c.Assert(err, NotNil)
+
+	ctx := context.Background()
+	path := filepath.Join(c.MkDir(), "yubi.db")
+	db, err := yubidb.OpenDb("file://" + path)
+	c.Assert(err, IsNil)
+	c.Assert(db.Dialect(), Equals, "sqlite")
+	version, err := db.SchemaVersion(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, 0)
+	pending, err := db.PendingMigrations(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(len(pending) > 0, Equals, true)
+
+	c.Assert(db.Migrate(ctx), IsNil)
+	version, err = db.SchemaVersion(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, pending[len(pending)-1].Version)
+	pending, err = db.PendingMigrations(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(pending, HasLen, 0)
+	// the copy of the deprecated table is skipped when there is none, rather than creating it
+	raw, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	c.Assert(err, IsNil)
+	c.Assert(raw.Migrator().HasTable("yubi_users"), Equals, false)
+	// applying again does nothing
+	c.Assert(db.Migrate(ctx), IsNil)
+
+	// a database migrated by a newer program is refused
+	c.Assert(raw.Create(&yubidb.SchemaVersion{Version: version + 1, Name: "future", AppliedAt: time.Now()}).Error, IsNil)
+	_, err = yubidb.NewDb("file://" + path)
+	c.Assert(err, ErrorMatches, ".*newer than the latest migration.*")
+}
+
+// encryptLegacy encrypts as the first release did; the hex nonce and AES-GCM ciphertext, with the first 32 hex
+// characters of SHA-256 of the passphrase as the key
+func encryptLegacy(c *C, data []byte, passphrase string) string {
+	sum := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher([]byte(hex.EncodeToString(sum[:])[:32]))
+	c.Assert(err, IsNil)
+	gcm, err := cipher.NewGCM(block)
+	c.Assert(err, IsNil)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	c.Assert(err, IsNil)
+	return hex.EncodeToString(gcm.Seal(nonce, nonce, data, nil))
+}
+
+func (s *YubiSuite) TestMigrateYubiUsers(c *C) {
+	path := filepath.Join(c.MkDir(), "yubi.db")
+	legacy, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	c.Assert(err, IsNil)
+	// the table of the first release, created by gorm v1 AutoMigrate
+	c.Assert(legacy.Exec(`CREATE TABLE "yubi_users" ("id" integer primary key autoincrement,"created_at" datetime,`+
+		`"updated_at" datetime,"email" varchar(255),"is_enabled" bool,"is_admin" bool,"counter" bigint,"session" bigint,`+
+		`"public" varchar(255) NOT NULL UNIQUE,"secret" varchar(255),"description" varchar(255))`).Error, IsNil)
+	// records without an email are of users of their own
+	for i, email := range []string{"one@domain.com", "one@domain.com", "two@domain.com", "", ""} {
+		tt := yubitest.TestTokens[i]
+		secret := encryptLegacy(c, []byte(tt.Secret), "test key")
+		c.Assert(legacy.Exec("INSERT INTO yubi_users (created_at, updated_at, email, is_enabled, is_admin, counter, "+
+			"session, public, secret, description) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", time.Now(), time.Now(), email,
+			true, false, 19, 1, tt.Pub, secret, "").Error, IsNil)
+	}
+	sqlDB, err := legacy.DB()
+	c.Assert(err, IsNil)
+	c.Assert(sqlDB.Close(), IsNil)
+
+	ctx := context.Background()
+	db, err := yubidb.NewDb("file://" + path)
+	c.Assert(err, IsNil)
+	db.SetSecretColumnKeyFunc(func() string { return "test key" })
+	version, err := db.SchemaVersion(ctx)
+	c.Assert(err, IsNil)
+	migrations, err := yubidb.Migrations("sqlite")
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, len(migrations))
+	users, err := db.GetAllUsers(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(len(users), Equals, 4)
+	c.Assert(users[0].Email, Equals, "one@domain.com")
+	c.Assert(users[3].Email, Equals, "")
+	devices, err := db.GetDevices(ctx, users[3].ID)
+	c.Assert(err, IsNil)
+	c.Assert(len(devices), Equals, 1)
+	c.Assert(devices[0].Public, Equals, yubitest.TestTokens[4].Pub)
+	devices, err = db.GetDevices(ctx, users[0].ID)
+	c.Assert(err, IsNil)
+	c.Assert(len(devices), Equals, 2)
+	c.Assert(string(devices[0].Secret), Equals, yubitest.TestTokens[0].Secret)
+	c.Assert(devices[0].Session, Equals, int64(1))
+
+	// the counters were copied
+	y, err := NewYubiAuth(WithDatabase(db))
+	c.Assert(err, IsNil)
+	y.SetToken(yubitest.TestTokens[2].Token(0))
+	_, _, err = y.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+	y.SetToken(yubitest.TestTokens[2].Token(1))
+	user, _, err := y.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(user.Email, Equals, "two@domain.com")
+}
+
+func (s *YubiSuite) TestRotateColumnKeys(c *C) {
+	ctx := context.Background()
+	path := filepath.Join(c.MkDir(), "yubi.db")
+	db, err := yubidb.NewDb("file://" + path)
+	c.Assert(err, IsNil)
+	db.SetSecretColumnKeyFunc(func() string { return "legacy key" })
+	user, err := db.AddUser(ctx, model.User{Email: "one@domain.com", IsEnabled: true})
+	c.Assert(err, IsNil)
+	for _, tt := range yubitest.TestTokens[:2] {
+		c.Assert(db.AddDevice(ctx, model.Device{UserID: user.ID, IsEnabled: true, Public: tt.Pub,
+			Secret: model.ColumnSecret(tt.Secret)}), IsNil)
+	}
+	c.Assert(db.RevokeDevice(ctx, yubitest.TestTokens[1].Pub), IsNil)
+	c.Assert(db.AddClient(ctx, model.APIClient{ClientID: "1", Secret: "api key", IsEnabled: true}), IsNil)
+
+	_, err = db.RotateColumnKeys(ctx)
+	c.Assert(err, ErrorMatches, "no column keyring.*")
+
+	kr, err := model.NewColumnKeyring("2026", map[string]string{"": "legacy key", "2026": "new key"})
+	c.Assert(err, IsNil)
+	y, err := NewYubiAuth(WithDatabase(db), WithColumnKeyring(kr))
+	c.Assert(err, IsNil)
+	// two devices, the revoked one included, and the client
+	n, err := y.GetDB().RotateColumnKeys(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	n, err = y.GetDB().RotateColumnKeys(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	// the legacy key is no longer needed
+	kr, err = model.NewColumnKeyring("2026", map[string]string{"2026": "new key"})
+	c.Assert(err, IsNil)
+	db.SetSecretColumnKeyring(kr)
+	device, err := db.GetDevice(ctx, yubitest.TestTokens[0].Pub)
+	c.Assert(err, IsNil)
+	c.Assert(string(device.Secret), Equals, yubitest.TestTokens[0].Secret)
+	client, err := db.GetClient(ctx, "1")
+	c.Assert(err, IsNil)
+	c.Assert(string(client.Secret), Equals, "api key")
+	y.SetToken(yubitest.TestTokens[0].Token(0))
+	_, _, err = y.Validate()
+	c.Assert(err, IsNil)
+}
+
+func (s *YubiSuite) TestSecretsBoundToDevice(c *C) {
+	ctx := context.Background()
+	path := filepath.Join(c.MkDir(), "yubi.db")
+	db, err := yubidb.NewDb("file://" + path)
+	c.Assert(err, IsNil)
+	db.SetSecretColumnKeyFunc(func() string { return "test key" })
+	user, err := db.AddUser(ctx, model.User{Email: "one@domain.com", IsEnabled: true})
+	c.Assert(err, IsNil)
+	for _, tt := range yubitest.TestTokens[:2] {
+		c.Assert(db.AddDevice(ctx, model.Device{UserID: user.ID, IsEnabled: true, Public: tt.Pub,
+			Secret: model.ColumnSecret(tt.Secret)}), IsNil)
+	}
+
+	// the secret of one device copied to the other does not decrypt
+	raw, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	c.Assert(err, IsNil)
+	c.Assert(raw.Exec("UPDATE devices SET secret = (SELECT secret FROM devices WHERE public = ?) WHERE public = ?",
+		yubitest.TestTokens[0].Pub, yubitest.TestTokens[1].Pub).Error, IsNil)
+	_, err = db.GetDevice(ctx, yubitest.TestTokens[1].Pub)
+	c.Assert(err, NotNil)
+	device, err := db.GetDevice(ctx, yubitest.TestTokens[0].Pub)
+	c.Assert(err, IsNil)
+	c.Assert(string(device.Secret), Equals, yubitest.TestTokens[0].Secret)
+
+	// whatever the order of the columns
+	device = &model.Device{}
+	keys := model.WithColumnKeys(ctx, &model.ColumnKeys{KeyFunc: func() string { return "test key" }})
+	c.Assert(raw.WithContext(keys).Select("secret", "public").Where("public = ?", yubitest.TestTokens[0].Pub).First(device).Error, IsNil)
+	c.Assert(string(device.Secret), Equals, yubitest.TestTokens[0].Secret)
+
+	// a query that skips the hook that decrypts does not yield a usable secret, nor one that is written back
+	device = &model.Device{}
+	skipHooks := raw.WithContext(keys).Session(&gorm.Session{SkipHooks: true})
+	c.Assert(skipHooks.Where("public = ?", yubitest.TestTokens[0].Pub).First(device).Error, IsNil)
+	c.Assert(string(device.Secret), Not(Equals), yubitest.TestTokens[0].Secret)
+	_, err = hex.DecodeString(string(device.Secret))
+	c.Assert(err, NotNil)
+	c.Assert(raw.WithContext(keys).Save(device).Error, ErrorMatches, ".*still encrypted.*")
+}
+
+func (s *YubiSuite) TestKeyProvider(c *C) {
+	ctx := context.Background()
+	db, err := yubidb.NewDb("file://" + filepath.Join(c.MkDir(), "yubi.db"))
+	c.Assert(err, IsNil)
+	db.SetSecretColumnKeyFunc(func() string { return "test key" })
+	user, err := db.AddUser(ctx, model.User{Email: "one@domain.com", IsEnabled: true})
+	c.Assert(err, IsNil)
+	tt := yubitest.TestTokens[0]
+	c.Assert(db.AddDevice(ctx, model.Device{UserID: user.ID, IsEnabled: true, Public: tt.Pub,
+		Secret: model.ColumnSecret(tt.Secret)}), IsNil)
+
+	kek, err := keyprovider.GenerateKEK()
+	c.Assert(err, IsNil)
+	c.Assert(os.Setenv("TEST_DB_COL_KEK", kek), IsNil)
+	defer func() { _ = os.Unsetenv("TEST_DB_COL_KEK") }()
+	kp, err := keyprovider.FromEnv("TEST_DB_COL_KEK")
+	c.Assert(err, IsNil)
+	y, err := NewYubiAuth(WithDatabase(db), WithKeyProvider(kp))
+	c.Assert(err, IsNil)
+	// the secret encrypted with the column key moves to envelope encryption
+	n, err := db.RotateColumnKeys(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	n, err = db.RotateColumnKeys(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	// after which the column key is no longer needed
+	db.SetSecretColumnKeyFunc(nil)
+	y.SetToken(tt.Token(0))
+	_, device, err := y.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(string(device.Secret), Equals, tt.Secret)
+
+	_, err = NewYubiAuth(WithKeyProvider(kp))
+	c.Assert(err, ErrorMatches, ".*requires a database")
+}
+
+func (s *YubiSuite) TestColumnKeysPerDatabase(c *C) {
+	ctx := context.Background()
+	tt := yubitest.TestTokens[0]
+	var auths []*YubiAuth
+	for _, key := range []string{"key one", "key two"} {
+		key := key
+		db, err := yubidb.NewDb("file://" + filepath.Join(c.MkDir(), "yubi.db"))
+		c.Assert(err, IsNil)
+		y, err := NewYubiAuth(WithDatabase(db), WithColumnKeyFunc(func() string { return key }))
+		c.Assert(err, IsNil)
+		user, err := db.AddUser(ctx, model.User{Email: "one@domain.com", IsEnabled: true})
+		c.Assert(err, IsNil)
+		c.Assert(db.AddDevice(ctx, model.Device{UserID: user.ID, IsEnabled: true, Public: tt.Pub,
+			Secret: model.ColumnSecret(tt.Secret)}), IsNil)
+		auths = append(auths, y)
+	}
+
+	// the keys of the second database did not replace those of the first
+	for _, y := range auths {
+		_, device, err := y.ValidateOTP(ctx, tt.Token(0))
+		c.Assert(err, IsNil)
+		c.Assert(string(device.Secret), Equals, tt.Secret)
+	}
+}
+
+func (s *YubiSuite) TestTimestampCheck(c *C) {
+	now := time.Now()
+	y := s.newYubiAuth(c, WithClock(func() time.Time { return now }))
+	tt := yubitest.TestTokens[0]
+
+	y.SetToken(tt.Token(0))
+	_, _, err := y.Validate()
+	c.Assert(err, IsNil)
+	device := s.readDevice()
+	c.Assert(device.LastSeen.Equal(now), Equals, true)
+
+	// the test tokens were generated at the same token time
+	now = now.Add(time.Second)
+	y.SetToken(tt.Token(1))
+	_, _, err = y.Validate()
+	c.Assert(err, IsNil)
+
+	// a minute later on the server but not on the token; warned but accepted
+	now = now.Add(time.Minute)
+	y.SetToken(tt.Token(2))
+	_, _, err = y.Validate()
+	c.Assert(err, IsNil)
+
+	now = now.Add(time.Minute)
+	y.SetTimestampCheck(TimestampCheck{Policy: TimestampReject, AbsTolerance: 20 * time.Second, RelTolerance: 0.3})
+	y.SetToken(tt.Token(3))
+	_, _, err = y.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.DELAYED_OTP)
+	c.Assert(s.readDevice().Session, Equals, int64(3))
+
+	// a new power-up session resets the token clock
+	device = s.readDevice()
+	device.Counter--
+	c.Assert(s.db.UpdateCounts(context.Background(), *device), IsNil)
+	_, _, err = y.Validate()
+	c.Assert(err, IsNil)
+}
+
+// testKSM a KSM over the test tokens
+type testKSM struct{}
+
+func (testKSM) Decrypt(_ context.Context, otp string) (*Token, error) {
+	for _, tt := range yubitest.TestTokens {
+		if strings.HasPrefix(otp, tt.Pub) {
+			key, _ := hex.DecodeString(tt.Secret)
+			return DecryptOTP([]byte(otp[PubLen:]), key)
+		}
+	}
+	return nil, common.UNREGISTERED_USER
+}
+
+func (s *YubiSuite) TestKSM(c *C) {
+	// the validation database does not hold the AES keys
+	s.db = yubitest.MapDbFromTestTokensWith(func(i int, device *model.Device) {
+		device.Secret = ""
+	})
+
+	y := s.newYubiAuth(c, WithKSM(testKSM{}))
+	y.SetToken(yubitest.TestTokens[0].Token(0))
+	_, _, err := y.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(s.readDevice().Session, Equals, int64(1))
+
+	_, _, err = y.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+}
+
+// newTestCloud a YubiCloud client of a verify endpoint over its own database of the test tokens. Close the server when done.
+func newTestCloud(c *C) (*yubico.YubiClient, *httptest.Server) {
+	apiKey := []byte("0123456789abcdef0123")
+	cloud, err := NewYubiAuth(WithDatabase(yubitest.MapDbFromTestTokens()))
+	c.Assert(err, IsNil)
+	mux := http.NewServeMux()
+	mux.Handle(VerifyPath, NewVerifyHandler(cloud, StaticKeys{"42": apiKey}))
+	ts := httptest.NewServer(mux)
+	yc, err := yubico.NewYubiClient(
+		yubico.WithAPIServers([]string{ts.URL + VerifyPath}),
+		yubico.WithAPICreds("42", base64.StdEncoding.EncodeToString(apiKey)),
+	)
+	c.Assert(err, IsNil)
+	return yc, ts
+}
+
+func (s *YubiSuite) TestHybrid(c *C) {
+	yc, ts := newTestCloud(c)
+	defer ts.Close()
+
+	// the first Yubikey is registered for YubiCloud, the others are self-hosted
+	s.db = yubitest.MapDbFromTestTokensWith(func(i int, device *model.Device) {
+		if i == 0 {
+			device.Secret = ""
+		}
+	})
+
+	y := s.newYubiAuth(c, WithYubiCloud(yc))
+	y.SetToken(yubitest.TestTokens[0].Token(0))
+	_, _, err := y.Validate()
+	c.Assert(err, IsNil)
+	device := s.readDevice()
+	c.Assert(device.Counter, Equals, int64(19)) // as generated
+	c.Assert(device.Session, Equals, int64(1))
+	_, _, err = y.Validate()
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+
+	y.SetToken(yubitest.TestTokens[1].Token(0))
+	_, _, err = y.Validate()
+	c.Assert(err, IsNil)
+
+	// without a database every token goes to YubiCloud
+	y, err = NewYubiAuth(WithYubiCloud(yc))
+	c.Assert(err, IsNil)
+	y.SetToken(yubitest.TestTokens[2].Token(0))
+	_, device, err = y.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(device.Public, Equals, yubitest.TestTokens[2].Pub)
+
+	// no way to validate a device without a secret
+	y, err = NewYubiAuth()
+	c.Assert(err, IsNil)
+	y.SetToken(yubitest.TestTokens[2].Token(1))
+	_, _, err = y.Validate()
+	c.Assert(errors.Is(err, common.BACKEND_ERROR), Equals, true)
+}
+
+func (s *YubiSuite) TestValidator(c *C) {
+	ctx := context.Background()
+	v := s.newYubiAuth(c).Validator()
+	tt := yubitest.TestTokens[0]
+
+	res, err := v.Validate(ctx, tt.Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(res, Equals, common.Result{YubikeyID: tt.Pub, Counter: 19, Session: 1, Timestamp: res.Timestamp,
+		Status: common.OK, Backend: BackendName})
+	res, err = v.Validate(ctx, tt.Token(0))
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+	c.Assert(res.Status, Equals, common.REPLAYED_OTP)
+	c.Assert(res.YubikeyID, Equals, tt.Pub)
+
+	// the second Yubikey is registered with YubiCloud only
+	c.Assert(s.db.DeleteDevice(ctx, yubitest.TestTokens[1].Pub), IsNil)
+	yc, ts := newTestCloud(c)
+	defer ts.Close()
+	chain := common.NewChain(nil, v, yc.Validator())
+	res, err = chain.Validate(ctx, yubitest.TestTokens[1].Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(res.Backend, Equals, yubico.BackendName)
+	c.Assert(res.Session, Equals, uint(1))
+
+	// an OTP rejected by the self-hosted backend is not tried with YubiCloud
+	res, err = chain.Validate(ctx, tt.Token(0))
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+	c.Assert(res.Backend, Equals, BackendName)
+	res, err = chain.Validate(ctx, tt.Token(1))
+	c.Assert(err, IsNil)
+	c.Assert(res.Backend, Equals, BackendName)
+
+	// unless the policy says so
+	chain = common.NewChain(common.NextIf(common.REPLAYED_OTP), v, yc.Validator())
+	res, err = chain.Validate(ctx, tt.Token(1))
+	c.Assert(err, IsNil)
+	c.Assert(res.Backend, Equals, yubico.BackendName)
+
+	_, err = common.NewChain(nil).Validate(ctx, tt.Token(2))
+	c.Assert(err, yubitest.ErrorIs, common.BACKEND_ERROR)
 }
 
 func (s *YubiSuite) ExampleNewYubiAuth(c *C) {
-	y, err := NewYubiAuth("")
+	y, err := NewYubiAuth()
 	c.Assert(err, Equals, nil)
 
 	// this reads from a yubi press from stdin
@@ -104,7 +1031,8 @@ func (s *YubiSuite) ExampleNewYubiAuth(c *C) {
 	c.Assert(err, IsNil)
 	y.SetToken(otp)
 
-	user, err := y.Validate()
+	user, device, err := y.Validate()
 	c.Assert(err, IsNil)
 	c.Assert(user, NotNil)
+	c.Assert(device, NotNil)
 }
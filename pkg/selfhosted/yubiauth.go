@@ -1,65 +1,120 @@
 package selfhosted
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/dsggregory/yubiv/pkg/common"
 
 	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
 
 	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
+	"github.com/dsggregory/yubiv/pkg/yubico"
 	log "github.com/sirupsen/logrus"
 )
 
+// KSM a Key Storage Module that decrypts OTPs with AES keys kept apart from the validation database, so that
+// a compromised validation database does not leak the keys. See package ksm.
+type KSM interface {
+	// Decrypt deciphers the full OTP (public key and passcode). It does not check the counters of the token.
+	Decrypt(ctx context.Context, otp string) (*Token, error)
+}
+
 type YubiAuth struct {
-	db      yubidb.Databaser
-	done    bool
-	token   bytes.Buffer
-	nResets int
+	dsn           string
+	db            yubidb.Databaser
+	columnKey     model.SecretColumnKeyT
+	columnKeyring *model.ColumnKeyring
+	keyProvider   model.KeyProvider
+	logger        log.FieldLogger
+	ksm           KSM
+	// cloud validates OTPs of devices without a secret; YubiCloud or another Validation Protocol server
+	cloud   *yubico.YubiClient
+	tsCheck TimestampCheck
+	// now the clock used for timestamp checks; time.Now when nil
+	now func() time.Time
+	// session the token of the reader-based API of the authenticator; see Session
+	session *Session
 }
 
 func (y *YubiAuth) GetDB() yubidb.Databaser {
 	return y.db
 }
 
+// SetTimestampCheck specifies how OTPs whose token clock disagrees with the server clock are handled.
+// NewYubiAuth() uses DefaultTimestampCheck unless WithTimestampCheck() is given.
+func (y *YubiAuth) SetTimestampCheck(tc TimestampCheck) {
+	y.tsCheck = tc
+}
+
+// log the logger of the authenticator, which may have been created without NewYubiAuth()
+func (y *YubiAuth) log() log.FieldLogger {
+	if y.logger != nil {
+		return y.logger
+	}
+	return log.StandardLogger()
+}
+
+func (y *YubiAuth) clock() time.Time {
+	if y.now != nil {
+		return y.now()
+	}
+	return time.Now()
+}
+
+// SetKSM decrypt OTPs with a Key Storage Module instead of the AES secret of the device record. The database
+// then only holds the counters. Same as the WithKSM() option of NewYubiAuth().
+func (y *YubiAuth) SetKSM(k KSM) {
+	y.ksm = k
+}
+
+// defaultSession the session of the reader-based methods of the authenticator
+func (y *YubiAuth) defaultSession() *Session {
+	if y.session == nil {
+		y.session = y.NewSession()
+	}
+	return y.session
+}
+
+// Token the token read by the authenticator. See Session.Token().
 func (y *YubiAuth) Token() string {
-	return y.token.String()
+	return y.defaultSession().Token()
 }
 
+// Bytes the token read by the authenticator. See Session.Bytes().
 func (y *YubiAuth) Bytes() []byte {
-	return y.token.Bytes()
+	return y.defaultSession().Bytes()
 }
 
-// Public the public part of the token
+// Public the public part of the token. See Session.Public().
 func (y *YubiAuth) Public() string {
-	if y.token.Len() >= PubLen {
-		return y.token.String()[:PubLen]
-	}
-	return y.token.String()
+	return y.defaultSession().Public()
 }
 
-// Done finished reading the token?
+// Done finished reading the token? See Session.Done().
 func (y *YubiAuth) Done() bool {
-	return y.done
+	return y.defaultSession().Done()
 }
 
-// Reset make ready to read next token
+// Reset make ready to read next token. See Session.Reset().
 func (y *YubiAuth) Reset() {
-	y.nResets++
-	y.done = false
-	y.token.Truncate(0)
+	y.defaultSession().Reset()
 }
 
 // GetResetCount returns the number of times Reset() has been called
 func (y *YubiAuth) GetResetCount() int {
-	return y.nResets
+	return y.defaultSession().GetResetCount()
 }
 
 // RetryableError validation or other error is retryable?
 func (y *YubiAuth) RetryableError(err error) bool {
-	switch err {
+	if err == nil {
+		return false
+	}
+	switch common.StatusOf(err) {
 	case common.BAD_OTP, common.UNREGISTERED_USER, common.EMPTY_YUBI_TOKEN, common.NO_SUCH_CLIENT:
 		return true
 	default:
@@ -68,121 +123,318 @@ func (y *YubiAuth) RetryableError(err error) bool {
 }
 
 // ReadTokenData reads bytes from input until a CR is found. Returns true if the token has been fully consumed.
+// See Session.ReadTokenData().
 func (y *YubiAuth) ReadTokenData(reader io.Reader) bool {
-	if y.done {
-		log.Error("yubi token is already complete")
-		return y.done
-	}
-	_, err := io.Copy(&y.token, reader)
-	if err == nil {
-		l := y.token.Len()
-		if l > 0 && y.token.String()[l-1] == '\r' {
-			y.done = true
-			y.token.Truncate(l - 1) // strip the CR
-			log.Debug("read full yubi token")
-		}
-	} else {
-		log.WithError(err).Error("unable to taken data")
-	}
-
-	return y.done
+	return y.defaultSession().ReadTokenData(reader)
 }
 
-// SetToken instead of reading a token from input, set it from a string
+// SetToken instead of reading a token from input, set it from a string. See Session.SetToken().
 func (y *YubiAuth) SetToken(token string) {
-	y.token.Truncate(0)
-	y.token.Write([]byte(token))
-	y.done = true
+	y.defaultSession().SetToken(token)
 }
 
 // VerifyToken is not normally called. Use Validate() instead. This simply verifies the OTP but does not
 // determine if the token is registered, nor does it update token session counters in the DB.
-func (y *YubiAuth) VerifyToken(user model.YubiUser, token string) (*Token, error) {
+func (y *YubiAuth) VerifyToken(device model.Device, token string) (*Token, error) {
+	t, err := y.verifyToken(context.Background(), device, token)
+	return t, common.WrapValidationError(err, device.Public)
+}
+
+func (y *YubiAuth) verifyToken(ctx context.Context, device model.Device, token string) (*Token, error) {
 	var tokRslt *Token
-	if user.Secret != "" {
+	if y.ksm != nil {
+		// the KSM holds the AES key
+		t, err := y.ksm.Decrypt(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		if err = CheckPrivateID(device, t); err != nil {
+			return nil, err
+		}
+		if err = CheckCounters(device, t); err != nil {
+			return nil, err
+		}
+		tokRslt = t
+	} else if device.Secret != "" {
 		// self-hosted verification
 		_, otp, err := ParseToken(token)
 		if err != nil {
 			return nil, err
 		}
-		tokRslt, err = ShvValidateOTP(user, otp)
+		tokRslt, err = ShvValidateOTP(device, otp)
 		if err != nil {
 			return nil, err
 		}
-		/***
-		} else {
-			// Using Yubico servers for token validation
-			log.WithField("user", user.Email).Debug("using Yubico servers for OTP validation")
-			resp, err := otpv.VerifyOTP(token)
-			if err != nil {
-				return nil, err
-			}
-			tokRslt = &Token{
-				Ctr: uint16(resp.SessionCounter),
-				Use: uint8(resp.SessionUse),
-			}
-		*/
+	} else if y.cloud != nil {
+		// hybrid mode; the Yubikey slot of this device is configured for YubiCloud
+		y.log().WithField("device", device.Public).Debug("using Yubico servers for OTP validation")
+		resp, err := y.cloud.VerifyOTPContext(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		tokRslt = &Token{
+			Ctr:   uint16(resp.SessionCounter),
+			Use:   uint8(resp.SessionUse),
+			Tstpl: uint16(resp.Timestamp),
+			Tstph: uint8(resp.Timestamp >> 16),
+		}
+	} else {
+		return nil, common.NewValidationError(common.BACKEND_ERROR, device.Public,
+			errors.New("device has no secret and no YubiCloud client is configured"))
 	}
-
 	return tokRslt, nil
 }
 
 // Validate will validate the yubikey token we read.
-// Looks up yubikey ID from token to ensure user is registered.
-// For the self-hosted validation, it uses the user records secret key to decrypt the token.
-// Uses Yubico server validation when db is nil or user.secret is empty.
-// For self-hosted, the usage count will be updated in the database when the token successfully validates.
-// Returns a non-nil error if it cannot be validated or found in the database.
-func (y *YubiAuth) Validate() (*model.YubiUser, error) {
-	log.Debug("validating yubi token against database")
-	if y.token.Len() == 0 {
-		return nil, common.BAD_OTP
-	}
-
-	var user *model.YubiUser
-	if y.db != nil {
-		// Find the user corresponding to the public key of the token in the database
-		u, err := y.db.Get(y.Public())
-		if err != nil {
-			return nil, fmt.Errorf("%w; %s", err, common.UNREGISTERED_USER)
-		}
-		user = u
-		if user != nil && !user.IsEnabled {
-			return user, common.UNREGISTERED_USER
-		}
+// Looks up yubikey ID from token to ensure the device and its user are registered and enabled.
+// For the self-hosted validation, it uses the device's secret key to decrypt the token, or the KSM if one was set.
+// Uses the YubiCloud client given to NewYubiAuth() when there is no KSM and device.Secret is empty, which includes
+// every token when db is nil.
+// For self-hosted, the usage count of the device will be updated in the database when the token successfully validates.
+// Returns the owning user and the device, or a non-nil error if it cannot be validated or found in the database.
+// The token is held by the authenticator, so that Validate() and the methods that read the token may not be used by
+// concurrent goroutines. Use ValidateOTP(), or a Session of NewSession() for each, instead.
+func (y *YubiAuth) Validate() (*model.User, *model.Device, error) {
+	return y.ValidateContext(context.Background())
+}
 
-		tokRslt, err := y.VerifyToken(*user, y.token.String())
-		if err != nil {
-			return user, err
+// ValidateContext is Validate with a context that is passed to every database operation.
+func (y *YubiAuth) ValidateContext(ctx context.Context) (*model.User, *model.Device, error) {
+	return y.defaultSession().ValidateContext(ctx)
+}
+
+// ValidateOTP validates the OTP as Validate() does, but takes the token as an argument rather than reading it. It is
+// safe for concurrent use, so that one authenticator, and the pool of its database, may serve every request.
+func (y *YubiAuth) ValidateOTP(ctx context.Context, otp string) (*model.User, *model.Device, error) {
+	user, device, _, err := y.validate(ctx, otp)
+	return user, device, err
+}
+
+// lookupError reports a record of the Yubikey `ykid` that is not found as common.UNREGISTERED_USER and any other
+// database error as common.BACKEND_ERROR
+func lookupError(err error, ykid string) error {
+	if errors.Is(err, yubidb.ErrNotFound) {
+		return common.NewValidationError(common.UNREGISTERED_USER, ykid, err)
+	}
+	return common.NewValidationError(common.BACKEND_ERROR, ykid, err)
+}
+
+// validate does the work of Validate() for the given token without using the token read by YubiAuth.
+// Returns the user, device and the decrypted token when it validates, else a *common.ValidationError.
+func (y *YubiAuth) validate(ctx context.Context, token string) (ruser *model.User, rdevice *model.Device, rtok *Token, rerr error) {
+	y.log().Debug("validating yubi token against database")
+	pub := token
+	if len(pub) >= PubLen {
+		pub = pub[:PubLen]
+	}
+	defer func() {
+		rerr = common.WrapValidationError(rerr, pub)
+	}()
+	if len(token) == 0 {
+		return nil, nil, nil, common.BAD_OTP
+	}
+	// the OTP as typed in the keyboard layout of the host, in ModHex. A passcode of the characters of several layouts
+	// is tried in each until one is not a mismatch; else the error is that of the first.
+	candidates, err := common.OTPCandidates(token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, otp := range candidates {
+		user, device, tok, err := y.validateModHex(ctx, otp)
+		mismatch := common.IsLayoutMismatch(err)
+		if i == 0 || !mismatch {
+			ruser, rdevice, rtok, rerr = user, device, tok, err
+			if len(otp) >= PubLen {
+				pub = otp[:PubLen]
+			}
 		}
-		user.Counter = int64(tokRslt.Ctr)
-		user.Session = int64(tokRslt.Use)
-		err = y.db.UpdateCounts(*user)
-		if err != nil {
-			return user, err
+		if !mismatch {
+			break
 		}
-	} else {
+	}
+	return ruser, rdevice, rtok, rerr
+}
+
+// validateModHex validates the OTP, in ModHex, against its device
+func (y *YubiAuth) validateModHex(ctx context.Context, token string) (*model.User, *model.Device, *Token, error) {
+	pub := token
+	if len(pub) >= PubLen {
+		pub = pub[:PubLen]
+	}
+
+	if y.db == nil {
 		// no database, also indicates not self-hosted
-		user = &model.YubiUser{}
-		tokRslt, err := y.VerifyToken(*user, y.token.String())
+		device := &model.Device{Public: pub}
+		tokRslt, err := y.verifyToken(ctx, *device, token)
 		if err != nil {
-			return user, err
+			return nil, device, nil, err
 		}
-		user.Counter = int64(tokRslt.Ctr)
-		user.Session = int64(tokRslt.Use)
+		device.Counter = int64(tokRslt.Ctr)
+		device.Session = int64(tokRslt.Use)
+		return &model.User{}, device, tokRslt, nil
+	}
+
+	// Find the device corresponding to the public key of the token in the database, and its owner
+	device, err := y.db.GetDevice(ctx, pub)
+	if err != nil {
+		return nil, nil, nil, lookupError(err, pub)
+	}
+	user, err := y.db.GetUser(ctx, device.UserID)
+	if err != nil {
+		return nil, device, nil, lookupError(err, pub)
+	}
+	if !user.IsEnabled || !device.IsEnabled {
+		return user, device, nil, common.UNREGISTERED_USER
+	}
+
+	tokRslt, err := y.verifyToken(ctx, *device, token)
+	if err != nil {
+		return user, device, nil, err
+	}
+	now := y.clock()
+	if err = y.checkTimestamp(*device, tokRslt, now); err != nil {
+		return user, device, nil, err
+	}
+	device.Counter = int64(tokRslt.Ctr)
+	device.Session = int64(tokRslt.Use)
+	device.LastTimestamp = int64(tokRslt.Timestamp())
+	device.LastSeen = now
+	// fails if a concurrent request with the same OTP has advanced the counters since the device was read
+	if err = y.db.AdvanceCounts(ctx, *device); err != nil {
+		return user, device, nil, err
 	}
-	return user, nil
+	return user, device, tokRslt, nil
 }
 
-// NewYubiAuth creates an instance of a Yubi Key authenticator. If dsn is not empty, it specifies an implementation of a Databaser interface where self-hosted yubikeys are stored for valid users. Otherwise, Yubi tokens are validated by the default YubiCo services in the cloud.
-func NewYubiAuth(dsn string) (*YubiAuth, error) {
-	var db yubidb.Databaser
-	if dsn != "" {
-		d, err := yubidb.NewDb(dsn)
+// WithDSN an optional arg to NewYubiAuth that opens the database identified by dsn (see yubidb.NewDb()) where self-hosted
+// yubikeys are stored for valid users. May not be used with WithDatabase().
+func WithDSN(dsn string) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.dsn = dsn
+	}
+}
+
+// WithDatabase an optional arg to NewYubiAuth that specifies the database of valid users, such as a yubidb.MapDb or
+// your own implementation of the Databaser interface. May not be used with WithDSN().
+func WithDatabase(db yubidb.Databaser) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.db = db
+	}
+}
+
+// WithColumnKeyFunc an optional arg to NewYubiAuth that specifies the func called to acquire the application's secret
+// key for DB column encryption. Requires a database. The column keys are set on the database, so that YubiAuths of
+// different databases may have different keys but those that share a database share its keys.
+func WithColumnKeyFunc(kf model.SecretColumnKeyT) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.columnKey = kf
+	}
+}
+
+// WithColumnKeyring an optional arg to NewYubiAuth that specifies the keyring for DB column encryption, to rotate the
+// key. It is used instead of the key of WithColumnKeyFunc(). Requires a database.
+func WithColumnKeyring(kr *model.ColumnKeyring) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.columnKeyring = kr
+	}
+}
+
+// WithKeyProvider an optional arg to NewYubiAuth that specifies the KMS for envelope encryption of DB columns. Values
+// are then written with a data key wrapped by the provider instead of with the key of WithColumnKeyFunc() or
+// WithColumnKeyring(), which are still needed to read values written before. Requires a database.
+func WithKeyProvider(kp model.KeyProvider) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.keyProvider = kp
+	}
+}
+
+// WithLogger an optional arg to NewYubiAuth that specifies where validation is logged. Default is the logrus standard logger.
+func WithLogger(l log.FieldLogger) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.logger = l
+	}
+}
+
+// WithClock an optional arg to NewYubiAuth that specifies the clock used for timestamp checks and LastSeen. Default is time.Now.
+func WithClock(now func() time.Time) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.now = now
+	}
+}
+
+// WithYubiCloud an optional arg to NewYubiAuth that specifies the client that validates the OTPs of registered devices
+// that have no secret, such as the factory-programmed slot 1 of a Yubikey. When there is no database, every OTP is
+// validated with it.
+func WithYubiCloud(yc *yubico.YubiClient) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.cloud = yc
+	}
+}
+
+// WithKSM an optional arg to NewYubiAuth that decrypts OTPs with a Key Storage Module instead of the AES secret of the
+// device record. The database then only holds the counters.
+func WithKSM(k KSM) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.ksm = k
+	}
+}
+
+// WithTimestampCheck an optional arg to NewYubiAuth that specifies how OTPs whose token clock disagrees with the server
+// clock are handled. Default is DefaultTimestampCheck.
+func WithTimestampCheck(tc TimestampCheck) func(y *YubiAuth) {
+	return func(y *YubiAuth) {
+		y.tsCheck = tc
+	}
+}
+
+// NewYubiAuth creates an instance of a Yubi Key authenticator.
+//
+// Options may be one of the With*() functions. Ex. WithDSN(). With a database, self-hosted yubikeys are validated with
+// the secret of their device record, or with the KSM of WithKSM(), and the devices without a secret with the client of
+// WithYubiCloud(). Counters of all are recorded in the database. Without a database, OTPs are validated by YubiCloud.
+func NewYubiAuth(options ...func(y *YubiAuth)) (ry *YubiAuth, rerr error) {
+	y := &YubiAuth{tsCheck: DefaultTimestampCheck}
+
+	// catch panic() from optional arg funcs
+	defer func() {
+		if err := recover(); err != nil {
+			rerr = err.(error)
+		}
+	}()
+
+	for _, o := range options {
+		o(y)
+	}
+	if y.dsn != "" {
+		if y.db != nil {
+			return nil, fmt.Errorf("WithDSN() and WithDatabase() may not be used together")
+		}
+		d, err := yubidb.NewDb(y.dsn)
 		if err != nil {
 			return nil, err
 		}
-		db = d
+		y.db = d
+	}
+	if y.columnKey != nil {
+		if y.db == nil {
+			return nil, fmt.Errorf("WithColumnKeyFunc() requires a database")
+		}
+		y.db.SetSecretColumnKeyFunc(y.columnKey)
+	}
+	if y.columnKeyring != nil {
+		if y.db == nil {
+			return nil, fmt.Errorf("WithColumnKeyring() requires a database")
+		}
+		y.db.SetSecretColumnKeyring(y.columnKeyring)
+	}
+	if y.keyProvider != nil {
+		if y.db == nil {
+			return nil, fmt.Errorf("WithKeyProvider() requires a database")
+		}
+		y.db.SetSecretColumnKeyProvider(y.keyProvider)
+	}
+	if y.logger == nil {
+		y.logger = log.StandardLogger()
 	}
-	return &YubiAuth{db: db}, nil
+	return y, nil
 }
@@ -0,0 +1,28 @@
+package testing
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+type errorIsChecker struct {
+	*CheckerInfo
+}
+
+// ErrorIs checks that errors.Is(obtained, expected). Ex. c.Assert(err, ErrorIs, common.REPLAYED_OTP)
+var ErrorIs Checker = &errorIsChecker{
+	&CheckerInfo{Name: "ErrorIs", Params: []string{"obtained", "expected"}},
+}
+
+func (checker *errorIsChecker) Check(params []interface{}, names []string) (bool, string) {
+	target, ok := params[1].(error)
+	if !ok {
+		return false, "expected must be an error"
+	}
+	err, ok := params[0].(error)
+	if !ok {
+		return false, "obtained is not an error"
+	}
+	return errors.Is(err, target), ""
+}
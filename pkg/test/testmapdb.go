@@ -4,8 +4,8 @@ package testing
  */
 
 import (
+	"context"
 	"fmt"
-	"time"
 
 	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
 	"github.com/dsggregory/yubiv/pkg/selfhosted/model"
@@ -26,7 +26,8 @@ func (t TestToken) Token(i int) string {
 	return t.Pub + t.OTPs[i]
 }
 
-// TestTokens These values were generated for testing using https://github.com/Yubico/yubico-c
+// TestTokens These values were generated for testing using https://github.com/Yubico/yubico-c. Use otp.Generator for
+// new ones.
 var TestTokens = []TestToken{
 	{"6782a7960cf0", "9a781c53532db8eb0c51ed87188cae98", []string{
 		"jhvhgtetkdektuiucfgijuitkjjtdngt",
@@ -70,22 +71,33 @@ var TestTokens = []TestToken{
 	},
 }
 
+// MapDbFromTestTokens a database with one enabled user, test<i>@domain.com, for each test token and its device
 func MapDbFromTestTokens() *yubidb.MapDb {
+	return MapDbFromTestTokensWith(nil)
+}
+
+// MapDbFromTestTokensWith a database as MapDbFromTestTokens() whose device of the test token i is first changed by
+// edit, when not nil
+func MapDbFromTestTokensWith(edit func(i int, device *model.Device)) *yubidb.MapDb {
 	db := yubidb.NewMapDb()
 	for i, tt := range TestTokens {
-		_ = db.Add(model.YubiUser{
-			ID:          0,
-			CreatedAt:   time.Now(),
-			UpdatedAt:   time.Now(),
+		user, _ := db.AddUser(context.Background(), model.User{
 			Email:       fmt.Sprintf("test%d@domain.com", i),
 			IsAdmin:     false,
 			IsEnabled:   true,
-			Counter:     0,
-			Session:     0,
-			Public:      tt.Pub,
-			Secret:      model.ColumnSecret(tt.Secret),
 			Description: fmt.Sprintf("rec #%d", i),
 		})
+		device := model.Device{
+			UserID:    user.ID,
+			Label:     "primary",
+			IsEnabled: true,
+			Public:    tt.Pub,
+			Secret:    model.ColumnSecret(tt.Secret),
+		}
+		if edit != nil {
+			edit(i, &device)
+		}
+		_ = db.AddDevice(context.Background(), device)
 	}
 
 	return db
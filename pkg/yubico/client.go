@@ -11,6 +11,9 @@ import (
 	"crypto/hmac"
 	crand "crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -20,9 +23,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/dsggregory/yubiv/pkg/common"
@@ -45,8 +47,29 @@ type YubiClient struct {
 	apiKey []byte
 	// servers Array of Yubico servers used in OTP validation
 	servers []string
+	// fanOut when true, requests are sent to all servers at once and the first valid answer is used
+	fanOut bool
+	// timeout the limit on each HTTP request to a server. Zero means no limit other than the caller's context.
+	timeout time.Duration
+	// httpClient the client used to make requests to the servers
+	httpClient *http.Client
+	// tlsConfig optional TLS settings applied to the transport of httpClient
+	tlsConfig *tls.Config
+	// pins optional SHA-256 digests of the SubjectPublicKeyInfo that a server certificate chain must contain
+	pins [][]byte
+	// retry how requests that failed for a transient reason are retried
+	retry RetryPolicy
+	// breaker optional settings to skip servers that keep failing
+	breaker *CircuitBreaker
+	// mu protects states
+	mu sync.Mutex
+	// states circuit breaker state by server
+	states map[string]*breakerState
 }
 
+// DefaultTimeout the default limit on each HTTP request to a Yubico server
+const DefaultTimeout = 10 * time.Second
+
 // VerifyRequest A request to verify a OTP
 type VerifyRequest struct {
 	ID        string // Required Yubico Client ID associated with API key
@@ -92,26 +115,7 @@ func isValidResponseHash(m map[string]string, key []byte) bool {
 		return false
 	}
 
-	var keys []string
-	for k := range m {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	h := hmac.New(sha1.New, key)
-	var ampersand []byte
-	for _, k := range keys {
-		if k == "h" {
-			continue
-		}
-		_, _ = h.Write(ampersand)
-		_, _ = h.Write([]byte(k))
-		_, _ = h.Write([]byte{'='})
-		_, _ = h.Write([]byte(m[k]))
-		ampersand = []byte{'&'}
-	}
-
-	return hmac.Equal(exp, h.Sum(nil))
+	return hmac.Equal(exp, common.Signature(m, key))
 }
 
 func signRequest(req url.Values, key []byte) {
@@ -142,6 +146,8 @@ type VerifyResponse struct {
 	SessionUse uint
 	// SL percentage of external validation server that replied successfully (0 to 100)
 	SL int
+	// Server the URL of the validation server that answered the request
+	Server string
 }
 
 func parseTimestamp(t string) (time.Time, error) {
@@ -229,41 +235,32 @@ func (y *YubiClient) responseFromBody(body []byte) (*VerifyResponse, error) {
 	return r, nil
 }
 
-// Verify generic request. See VerifyDefault() for convenience.
-func (y *YubiClient) Verify(req *VerifyRequest) (*VerifyResponse, error) {
-
-	// random server
-	server := y.servers[rand.Intn(len(y.servers))]
-
-	if req.ID == "" {
-		req.ID = y.id
-	}
-
-	req.OTP = strings.Trim(req.OTP, "\n")
-	if len(req.OTP) != common.TokenLen {
-		return nil, common.BAD_OTP
-	}
-
-	values := req.toValues()
-
-	if y.apiKey != nil {
-		signRequest(values, y.apiKey)
-	}
-
+// verifyServer sends the signed request values to a single server and checks the response against the request.
+func (y *YubiClient) verifyServer(ctx context.Context, server string, req *VerifyRequest, values url.Values) (*VerifyResponse, error) {
 	hreq, err := http.NewRequest(http.MethodGet, server+"?"+values.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(hreq.Context(), 10*time.Second)
-	defer cancel()
+	if y.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, y.timeout)
+		defer cancel()
+	}
 	hreq = hreq.WithContext(ctx)
-	resp, err := http.DefaultClient.Do(hreq)
+	resp, err := y.httpClient.Do(hreq)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%w; %s responded %s", errServerUnavailable, server, resp.Status)
+		}
+		return nil, fmt.Errorf("%s responded %s", server, resp.Status)
+	}
+
 	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*4))
 	if err != nil {
 		return nil, err
@@ -281,10 +278,177 @@ func (y *YubiClient) Verify(req *VerifyRequest) (*VerifyResponse, error) {
 	if response.Nonce != req.Nonce {
 		return nil, errors.New("response Nonce does not match")
 	}
+	response.Server = server
 
 	return response, nil
 }
 
+// verifyAll sends the request to every server at the same time. The first signature-checked response
+// whose status is not a transient server condition wins and the remaining requests are cancelled.
+// REPLAYED_REQUEST is not an answer either; a server that has synced the OTP from another one that was
+// sent the same request reports it, so it is ignored as the Validation Protocol asks of such clients.
+// If no server gives a definitive answer, the last response received is returned, else the first error.
+func (y *YubiClient) verifyAll(ctx context.Context, servers []string, req *VerifyRequest, values url.Values) (*VerifyResponse, error) {
+	type result struct {
+		resp *VerifyResponse
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			resp, err := y.tryServer(ctx, server, req, values)
+			results <- result{resp: resp, err: err}
+		}(server)
+	}
+
+	var lastResp *VerifyResponse
+	var firstErr error
+	for range servers {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		if !r.resp.Status.IsTransient() && r.resp.Status != common.REPLAYED_REQUEST {
+			return r.resp, nil
+		}
+		lastResp = r.resp
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+
+	return nil, firstErr
+}
+
+// verifyOnce makes one attempt at the request using the servers whose circuit is closed
+func (y *YubiClient) verifyOnce(ctx context.Context, req *VerifyRequest, values url.Values) (*VerifyResponse, error) {
+	servers := y.availableServers()
+	if y.fanOut && len(servers) > 1 {
+		return y.verifyAll(ctx, servers, req, values)
+	}
+
+	// random server
+	server := servers[rand.Intn(len(servers))]
+
+	return y.tryServer(ctx, server, req, values)
+}
+
+// Verify generic request. See VerifyDefault() for convenience.
+//
+// By default one server is chosen at random. See WithFanOut() to query all servers at once, and
+// WithRetryPolicy() and WithCircuitBreaker() to handle failing servers.
+func (y *YubiClient) Verify(req *VerifyRequest) (*VerifyResponse, error) {
+	return y.VerifyContext(context.Background(), req)
+}
+
+// VerifyContext is Verify with a context that bounds the HTTP requests. The client timeout (see WithTimeout())
+// still applies when the context has a later deadline. req.OTP is translated to ModHex from the keyboard layout it was
+// typed in, see common.NormalizeOTP(). An OTP of the characters of several layouts is verified again in the next
+// layout while the servers answer BAD_OTP; see common.OTPCandidates(). Each layout is then a separate signed request,
+// and counts as such with the servers, for up to len(common.Layouts) requests of one OTP. The translations of the
+// other layouts are sent only when they are all ModHex; see layoutCandidates().
+func (y *YubiClient) VerifyContext(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error) {
+	if req.ID == "" {
+		req.ID = y.id
+	}
+
+	// the OTP as typed in the keyboard layout of the host, in ModHex
+	candidates, err := layoutCandidates(req.OTP)
+	if err != nil {
+		return nil, err
+	}
+	req.OTP = candidates[0]
+
+	resp, err := y.verifyModHex(ctx, req)
+	for _, otp := range candidates[1:] {
+		if err != nil || resp.Status != common.BAD_OTP {
+			break
+		}
+		next := *req
+		next.OTP = otp
+		nresp, nerr := y.verifyModHex(ctx, &next)
+		if nerr == nil && nresp.Status != common.BAD_OTP {
+			*req = next
+			return nresp, nil
+		}
+	}
+	return resp, err
+}
+
+// layoutCandidates the translations of common.OTPCandidates() to send to the servers, of the length of an OTP. The
+// first is that of common.NormalizeOTP(), whose public ID may be of another alphabet. The others are sent only when
+// they are all ModHex, since a character kept as it is tells that the OTP was not typed in that layout. The
+// translations are distinct, so that a layout is tried only when the OTP types differently in it.
+func layoutCandidates(otp string) ([]string, error) {
+	all, err := common.OTPCandidates(otp)
+	if err != nil {
+		return nil, err
+	}
+	if len(all[0]) != common.TokenLen {
+		return nil, common.BAD_OTP
+	}
+	candidates := all[:1]
+	for _, c := range all[1:] {
+		if common.IsModHex(c) {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates, nil
+}
+
+// verifyModHex verifies the request of an OTP in ModHex, retrying as the RetryPolicy allows. Each retry is sent with
+// a new nonce. The servers may have stored the OTP of an attempt whose answer was lost or transient, so that a retry
+// answered REPLAYED_REQUEST or REPLAYED_OTP returns the answer of the attempt before it rather than report a replay.
+func (y *YubiClient) verifyModHex(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error) {
+	var (
+		prevResp *VerifyResponse
+		prevErr  error
+	)
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			nonce, err := newNonce()
+			if err != nil {
+				return prevResp, prevErr
+			}
+			req.Nonce = nonce
+		}
+		values := req.toValues()
+		if y.apiKey != nil {
+			signRequest(values, y.apiKey)
+		}
+
+		resp, err := y.verifyOnce(ctx, req, values)
+		if attempt > 1 && err == nil && (resp.Status == common.REPLAYED_REQUEST || resp.Status == common.REPLAYED_OTP) {
+			return prevResp, prevErr
+		}
+		if attempt >= y.retry.MaxAttempts || !isRetryable(ctx, resp, err) {
+			return resp, err
+		}
+		prevResp, prevErr = resp, err
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(y.retry.backoff(attempt)):
+		}
+	}
+}
+
+// newNonce returns a random nonce of a verify request
+func newNonce() (string, error) {
+	nb := make([]byte, 32)
+	if _, err := io.ReadFull(crand.Reader, nb); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", nb)[:40], nil // request takes max of 40 characters for nonce
+}
+
 // APIEnvironment reads well-known environment variables (YUBICO_API_CLIENT_ID, YUBICO_API_SECRET_KEY) to get your Yubi client API creds. Note that YUBICO_API_SECRET_KEY must be base64-encoded.
 func APIEnvironment() (clientID string, secretKey string, err error) {
 	clientID = os.Getenv("YUBICO_API_CLIENT_ID")
@@ -299,13 +463,19 @@ func APIEnvironment() (clientID string, secretKey string, err error) {
 	return
 }
 
-// VerifyOTP formats and makes a request to validate a OTP from Yubico API. If it could not validate for any reason, an error is returned.
+// VerifyOTP formats and makes a request to validate a OTP from Yubico API. If it could not validate for any reason, a
+// *common.ValidationError is returned; with the Status of the response, or BACKEND_ERROR and the cause when there was
+// no response.
 func (y *YubiClient) VerifyOTP(otp string) (*VerifyResponse, error) {
-	nb := make([]byte, 32)
-	if _, err := io.ReadFull(crand.Reader, nb); err != nil {
+	return y.VerifyOTPContext(context.Background(), otp)
+}
+
+// VerifyOTPContext is VerifyOTP with a context for deadlines and cancellation of the request.
+func (y *YubiClient) VerifyOTPContext(ctx context.Context, otp string) (*VerifyResponse, error) {
+	nonce, err := newNonce()
+	if err != nil {
 		return nil, err
 	}
-	nonce := fmt.Sprintf("%x", nb)[:40] // request takes max of 40 characters for nonce
 
 	req := VerifyRequest{
 		OTP:       otp,
@@ -314,12 +484,17 @@ func (y *YubiClient) VerifyOTP(otp string) (*VerifyResponse, error) {
 		SL:        "0",
 		Timeout:   0,
 	}
-	resp, err := y.Verify(&req)
+	resp, err := y.VerifyContext(ctx, &req)
+	// req.OTP is now in ModHex
+	ykid := req.OTP
+	if len(ykid) > common.TokenIDLen {
+		ykid = ykid[:common.TokenIDLen]
+	}
 	if err != nil {
-		return nil, err
+		return nil, common.WrapValidationError(err, ykid)
 	}
 	if resp.Status != common.OK {
-		return resp, fmt.Errorf(resp.Status.String())
+		return resp, common.NewValidationError(resp.Status, ykid, nil)
 	}
 
 	return resp, nil
@@ -343,6 +518,125 @@ func WithAPIServers(servers []string) func(y *YubiClient) {
 	}
 }
 
+// WithFanOut an optional arg to NewYubiClient that sends each request to all servers in parallel, as recommended by
+// the Validation Protocol. The first valid answer is used and the outstanding requests are cancelled.
+// VerifyResponse.Server reports the server that answered.
+func WithFanOut() func(y *YubiClient) {
+	return func(y *YubiClient) {
+		y.fanOut = true
+	}
+}
+
+// WithTimeout an optional arg to NewYubiClient that limits each HTTP request to a server. Default is DefaultTimeout.
+// A zero duration leaves the limit to the context passed to VerifyContext().
+func WithTimeout(d time.Duration) func(y *YubiClient) {
+	return func(y *YubiClient) {
+		y.timeout = d
+	}
+}
+
+// WithHTTPClient an optional arg to NewYubiClient that specifies the HTTP client used to reach the servers. Default is http.DefaultClient.
+// Use it for proxies, connection-pool tuning or to record traffic in tests.
+func WithHTTPClient(c *http.Client) func(y *YubiClient) {
+	return func(y *YubiClient) {
+		y.httpClient = c
+	}
+}
+
+// WithTLSConfig an optional arg to NewYubiClient that specifies TLS settings such as custom root CAs or client
+// certificates for mTLS. It is applied to a copy of the transport of the HTTP client, which must be an *http.Transport.
+func WithTLSConfig(cfg *tls.Config) func(y *YubiClient) {
+	return func(y *YubiClient) {
+		y.tlsConfig = cfg
+	}
+}
+
+// WithSPKIPins an optional arg to NewYubiClient that pins the servers' public keys. Each pin is the base64-encoded
+// SHA-256 digest of a certificate's SubjectPublicKeyInfo (see SPKIPin()). A connection is refused unless a
+// certificate in the server's verified chain matches one of the pins.
+func WithSPKIPins(pins ...string) func(y *YubiClient) {
+	return func(y *YubiClient) {
+		for _, p := range pins {
+			d, err := base64.StdEncoding.DecodeString(p)
+			if err != nil {
+				panic(err)
+			}
+			if len(d) != sha256.Size {
+				panic(fmt.Errorf("SPKI pin %q is not a SHA-256 digest", p))
+			}
+			y.pins = append(y.pins, d)
+		}
+	}
+}
+
+// SPKIPin returns the base64-encoded SHA-256 digest of the certificate's SubjectPublicKeyInfo, for use with WithSPKIPins().
+func SPKIPin(cert *x509.Certificate) string {
+	d := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(d[:])
+}
+
+// verifyPins checks that a certificate of the connection matches one of the pins
+func (y *YubiClient) verifyPins(cs tls.ConnectionState) error {
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(certs) == 0 && len(cs.PeerCertificates) > 0 {
+		// InsecureSkipVerify; only the leaf can be trusted to belong to the server
+		certs = cs.PeerCertificates[:1]
+	}
+	for _, cert := range certs {
+		d := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range y.pins {
+			if bytes.Equal(d[:], pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate of %s matches a pinned public key", cs.ServerName)
+}
+
+// configureTLS replaces the HTTP client with a copy whose transport uses the TLS config and pins
+func (y *YubiClient) configureTLS() error {
+	var t *http.Transport
+	switch rt := y.httpClient.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		t = rt.Clone()
+	default:
+		return fmt.Errorf("TLS options require an *http.Transport, not %T", rt)
+	}
+
+	cfg := y.tlsConfig
+	if cfg == nil {
+		cfg = t.TLSClientConfig
+	}
+	if cfg == nil {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if len(y.pins) > 0 {
+		// the pins are checked in addition to the caller's own callback, if any
+		verify := cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			return y.verifyPins(cs)
+		}
+	}
+	t.TLSClientConfig = cfg
+
+	c := *y.httpClient
+	c.Transport = t
+	y.httpClient = &c
+	return nil
+}
+
 func apikeyDecode(apikey string) ([]byte, error) {
 	key, err := base64.StdEncoding.DecodeString(apikey)
 	if err != nil {
@@ -386,7 +680,7 @@ func WithAPICreds(id string, apikeyB64 string) func(y *YubiClient) {
 //
 // See [Obtain a Yubico API Key]: https://support.yubico.com/hc/en-us/articles/360013717560-Obtaining-an-API-Key-for-YubiKey-Development
 func NewYubiClient(options ...func(client *YubiClient)) (ry *YubiClient, rerr error) {
-	y := &YubiClient{}
+	y := &YubiClient{timeout: DefaultTimeout}
 
 	// catch panic() from optional arg funcs
 	defer func() {
@@ -401,6 +695,14 @@ func NewYubiClient(options ...func(client *YubiClient)) (ry *YubiClient, rerr er
 	if y.servers == nil {
 		y.servers = YubiCloudServers
 	}
+	if y.httpClient == nil {
+		y.httpClient = http.DefaultClient
+	}
+	if y.tlsConfig != nil || len(y.pins) > 0 {
+		if err := y.configureTLS(); err != nil {
+			return nil, err
+		}
+	}
 	// use environment if WithAPICreds() option was not used
 	if y.apiKey == nil {
 		apiID, apiKey, err := APIEnvironment()
@@ -418,5 +720,5 @@ func NewYubiClient(options ...func(client *YubiClient)) (ry *YubiClient, rerr er
 
 // NewTestYubiClient a test suite function
 func NewTestYubiClient(server string) (*YubiClient, error) {
-	return &YubiClient{id: "test", apiKey: []byte(""), servers: []string{server}}, nil
+	return &YubiClient{id: "test", apiKey: []byte(""), servers: []string{server}, timeout: DefaultTimeout, httpClient: http.DefaultClient}, nil
 }
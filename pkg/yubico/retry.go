@@ -0,0 +1,184 @@
+package yubico
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// errServerUnavailable the server answered with an HTTP status that says it could not handle the request
+var errServerUnavailable = errors.New("validation server unavailable")
+
+// RetryPolicy specifies how a request is retried when it fails for a reason that is safe to retry; a timeout, a
+// connection refused or reset, an HTTP 5xx, or a response status for which Status.IsTransient() is true. Each retry
+// picks a server again and has a new nonce. Since the servers may have stored the OTP of the attempt before, a retry
+// answered with a replay status returns the answer of that attempt instead.
+type RetryPolicy struct {
+	// MaxAttempts the total number of attempts including the first. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff the upper bound on the wait between attempts. Zero means no bound.
+	MaxBackoff time.Duration
+	// Multiplier the factor applied to the wait after each retry. Values below 1 keep the wait constant.
+	Multiplier float64
+}
+
+// DefaultRetryPolicy a reasonable policy to use with WithRetryPolicy()
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// backoff returns the wait before the retry that follows attempt number `attempt`. Jitter of up to half the wait is
+// subtracted so that clients do not retry in lockstep.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt && p.Multiplier > 1; i++ {
+		d *= p.Multiplier
+		if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+// isRetryable the result of an attempt may be retried without risk of a different answer about the OTP
+func isRetryable(ctx context.Context, resp *VerifyResponse, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err == nil {
+		return resp != nil && resp.Status.IsTransient()
+	}
+	if errors.Is(err, errServerUnavailable) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	// not TLS failures, such as a pin mismatch, which are not fixed by asking again
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// CircuitBreaker specifies when a server is skipped. After Threshold consecutive failures, the server is not used for
+// Cooldown. It is then tried again, and one more failure opens its circuit for another Cooldown.
+// When every server is open, all of them are tried rather than failing the request.
+type CircuitBreaker struct {
+	// Threshold the number of consecutive failures that opens the circuit of a server
+	Threshold int
+	// Cooldown how long a server with an open circuit is skipped
+	Cooldown time.Duration
+}
+
+// ServerState the circuit breaker state of a server. See YubiClient.ServerStates().
+type ServerState struct {
+	// Server the URL of the validation server
+	Server string
+	// Failures the number of consecutive failed requests to the server
+	Failures int
+	// Open whether the server is being skipped
+	Open bool
+	// OpenUntil when the server will be tried again, if Open
+	OpenUntil time.Time
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// availableServers the servers whose circuit is closed, or all servers if none are
+func (y *YubiClient) availableServers() []string {
+	if y.breaker == nil {
+		return y.servers
+	}
+	now := time.Now()
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	var servers []string
+	for _, server := range y.servers {
+		if st := y.states[server]; st == nil || !now.Before(st.openUntil) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return y.servers
+	}
+	return servers
+}
+
+// tryServer verifies with a single server and records the outcome with the circuit breaker
+func (y *YubiClient) tryServer(ctx context.Context, server string, req *VerifyRequest, values url.Values) (*VerifyResponse, error) {
+	resp, err := y.verifyServer(ctx, server, req, values)
+	if y.breaker == nil || ctx.Err() != nil {
+		// a cancelled request says nothing about the health of the server
+		return resp, err
+	}
+	failed := err != nil || resp.Status.IsTransient()
+
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	st := y.states[server]
+	if st == nil {
+		st = &breakerState{}
+		y.states[server] = st
+	}
+	if !failed {
+		st.failures = 0
+		st.openUntil = time.Time{}
+		return resp, err
+	}
+	st.failures++
+	if st.failures >= y.breaker.Threshold {
+		st.openUntil = time.Now().Add(y.breaker.Cooldown)
+	}
+
+	return resp, err
+}
+
+// ServerStates returns the circuit breaker state of each server. Without WithCircuitBreaker() every server is always closed.
+func (y *YubiClient) ServerStates() []ServerState {
+	now := time.Now()
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	states := make([]ServerState, 0, len(y.servers))
+	for _, server := range y.servers {
+		ss := ServerState{Server: server}
+		if st := y.states[server]; st != nil {
+			ss.Failures = st.failures
+			ss.Open = now.Before(st.openUntil)
+			if ss.Open {
+				ss.OpenUntil = st.openUntil
+			}
+		}
+		states = append(states, ss)
+	}
+	return states
+}
+
+// WithRetryPolicy an optional arg to NewYubiClient that retries requests that fail for a transient reason.
+// Default is no retries. See DefaultRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) func(y *YubiClient) {
+	return func(y *YubiClient) {
+		y.retry = p
+	}
+}
+
+// WithCircuitBreaker an optional arg to NewYubiClient that skips servers that keep failing. See CircuitBreaker.
+func WithCircuitBreaker(cb CircuitBreaker) func(y *YubiClient) {
+	return func(y *YubiClient) {
+		if cb.Threshold < 1 {
+			cb.Threshold = 1
+		}
+		y.breaker = &cb
+		y.states = make(map[string]*breakerState)
+	}
+}
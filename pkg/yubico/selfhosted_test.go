@@ -0,0 +1,68 @@
+package yubico_test
+
+/*** Tests that use the selfhosted package, which imports yubico, to simulate the Yubico servers
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+	"github.com/dsggregory/yubiv/pkg/selfhosted"
+	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
+	yubitest "github.com/dsggregory/yubiv/pkg/test"
+	"github.com/dsggregory/yubiv/pkg/yubico"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&selfhostedSuite{})
+
+type selfhostedSuite struct {
+	mapDB *yubidb.MapDb
+}
+
+func (s *selfhostedSuite) SetUpTest(c *C) {
+	s.mapDB = yubitest.MapDbFromTestTokens()
+}
+
+func (s *selfhostedSuite) TestYubioServerVerify(c *C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// leverages selfhosted to simulate response from https://api.yubico.com/wsapi/2.0/verify
+		otp := r.URL.Query().Get("otp")
+		rnonce := r.URL.Query().Get("nonce")
+		status := common.OK.String()
+		device, err := s.mapDB.GetDevice(r.Context(), otp[:common.TokenIDLen])
+		if err != nil {
+			status = common.NO_SUCH_CLIENT.String()
+		} else {
+			_, err = selfhosted.ShvValidateOTP(*device, []byte(otp))
+			if err != nil {
+				status = err.Error()
+			}
+		}
+		tms := time.Now().Format("2006-01-02T15:04:05")
+		_, _ = fmt.Fprintf(w, `
+status=%s
+otp=%s
+nonce=%s
+t=%sZ0000
+`,
+			status, otp, rnonce, tms)
+	}))
+	defer ts.Close()
+
+	yc, err := yubico.NewTestYubiClient(ts.URL)
+	c.Assert(err, IsNil)
+
+	// should verify
+	res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(res, NotNil)
+
+	// should fail unable to look up the yubikey ID
+	res, err = yc.VerifyOTP("unknown ID+2" + yubitest.TestTokens[0].Token(0)[common.TokenIDLen:])
+	c.Assert(err, NotNil)
+	c.Assert(err, yubitest.ErrorIs, common.NO_SUCH_CLIENT)
+}
@@ -0,0 +1,33 @@
+package yubico
+
+import (
+	"context"
+
+	"github.com/dsggregory/yubiv/pkg/common"
+)
+
+// BackendName the name of YubiCloud, or another Validation Protocol server, in common.Result.Backend
+const BackendName = "yubicloud"
+
+// validator the common.Validator of a YubiClient
+type validator struct {
+	client *YubiClient
+}
+
+// Validator returns the client as a common.Validator
+func (y *YubiClient) Validator() common.Validator {
+	return validator{client: y}
+}
+
+// Validate validates the OTP with VerifyOTPContext()
+func (v validator) Validate(ctx context.Context, otp string) (common.Result, error) {
+	resp, err := v.client.VerifyOTPContext(ctx, otp)
+	res := common.NewResult(BackendName, otp, err)
+	if resp != nil {
+		res.Status = resp.Status
+		res.Counter = resp.SessionCounter
+		res.Session = resp.SessionUse
+		res.Timestamp = resp.Timestamp
+	}
+	return res, err
+}
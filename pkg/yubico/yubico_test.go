@@ -2,18 +2,20 @@ package yubico
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/dsggregory/yubiv/pkg/common"
-	"github.com/dsggregory/yubiv/pkg/selfhosted"
-
-	yubidb "github.com/dsggregory/yubiv/pkg/selfhosted/database"
-
 	yubitest "github.com/dsggregory/yubiv/pkg/test"
 	. "gopkg.in/check.v1"
 )
@@ -25,11 +27,6 @@ func Test(t *testing.T) {
 var _ = Suite(&yubicoSuite{})
 
 type yubicoSuite struct {
-	mapDB *yubidb.MapDb
-}
-
-func (s *yubicoSuite) SetUpTest(c *C) {
-	s.mapDB = yubitest.MapDbFromTestTokens()
 }
 
 func (s *yubicoSuite) TestNewYubiClient(c *C) {
@@ -58,42 +55,363 @@ func (s *yubicoSuite) TestNewYubiClient(c *C) {
 	c.Assert(y.servers[0], Equals, server)
 }
 
-func (s *yubicoSuite) TestYubioServerVerify(c *C) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// leverages selfhosted to simulate response from https://api.yubico.com/wsapi/2.0/verify
-		otp := r.URL.Query().Get("otp")
-		rnonce := r.URL.Query().Get("nonce")
-		status := common.OK.String()
-		user, err := s.mapDB.Get(otp[:common.TokenIDLen])
-		if err != nil {
-			status = common.NO_SUCH_CLIENT.String()
-		} else {
-			_, err = selfhosted.ShvValidateOTP(*user, []byte(otp))
-			if err != nil {
-				status = err.Error()
-			}
+// fakeServer responds to every verify request with `status` after `delay`, or until the request is cancelled
+func fakeServer(status common.Status, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(fakeHandler(status, delay))
+}
+
+func fakeHandler(status common.Status, delay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
 		}
 		tms := time.Now().Format("2006-01-02T15:04:05")
-		_, _ = fmt.Fprintf(w, `
-status=%s
-otp=%s
-nonce=%s
-t=%sZ0000
-`,
-			status, otp, rnonce, tms)
+		_, _ = fmt.Fprintf(w, "status=%s\notp=%s\nnonce=%s\nt=%sZ0000\n",
+			status, r.URL.Query().Get("otp"), r.URL.Query().Get("nonce"), tms)
+	})
+}
+
+func (s *yubicoSuite) TestVerifyFanOut(c *C) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	busy := fakeServer(common.BACKEND_ERROR, 0)
+	defer busy.Close()
+	slow := fakeServer(common.OK, time.Minute)
+	defer slow.Close()
+	good := fakeServer(common.OK, 50*time.Millisecond)
+	defer good.Close()
+
+	yc, err := NewTestYubiClient(good.URL)
+	c.Assert(err, IsNil)
+	yc.servers = []string{down.URL, busy.URL, slow.URL, good.URL}
+	WithFanOut()(yc)
+
+	start := time.Now()
+	res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.OK)
+	c.Assert(res.Server, Equals, good.URL)
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+
+	// no definitive answer from any server
+	yc.servers = []string{down.URL, busy.URL}
+	res, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, NotNil)
+	c.Assert(err, yubitest.ErrorIs, common.BACKEND_ERROR)
+	c.Assert(res.Server, Equals, busy.URL)
+}
+
+func (s *yubicoSuite) TestValidator(c *C) {
+	good := fakeServer(common.OK, 0)
+	defer good.Close()
+	yc, err := NewTestYubiClient(good.URL)
+	c.Assert(err, IsNil)
+
+	otp := yubitest.TestTokens[0].Token(0)
+	res, err := yc.Validator().Validate(context.Background(), otp)
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.OK)
+	c.Assert(res.Backend, Equals, BackendName)
+	c.Assert(res.YubikeyID, Equals, yubitest.TestTokens[0].Pub)
+
+	replayed := fakeServer(common.REPLAYED_OTP, 0)
+	defer replayed.Close()
+	yc.servers = []string{replayed.URL}
+	res, err = yc.Validator().Validate(context.Background(), otp)
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_OTP)
+	c.Assert(res.Status, Equals, common.REPLAYED_OTP)
+	c.Assert(res.YubikeyID, Equals, yubitest.TestTokens[0].Pub)
+}
+
+func (s *yubicoSuite) TestKeyboardLayouts(c *C) {
+	good := fakeServer(common.OK, 0)
+	defer good.Close()
+	yc, err := NewTestYubiClient(good.URL)
+	c.Assert(err, IsNil)
+
+	// the server is sent the OTP in ModHex
+	otp := yubitest.TestTokens[0].Token(0)
+	res, err := yc.VerifyOTP(common.LayoutDvorak.FromModHex(otp))
+	c.Assert(err, IsNil)
+	c.Assert(res.OTP, Equals, otp)
+
+	_, err = yc.VerifyOTP(otp[:len(otp)-1] + "z")
+	c.Assert(err, yubitest.ErrorIs, common.BAD_OTP)
+
+	// typed on Colemak, but of ModHex characters only; the server rejects it as QWERTY
+	otp = "cccccccccccb" + "cbefghijklntuvcbefghijklntuvcbef"
+	colemak := common.LayoutColemak.FromModHex(otp)
+	c.Assert(common.IsModHex(colemak), Equals, true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := common.BAD_OTP
+		if r.URL.Query().Get("otp") == otp {
+			status = common.OK
+		}
+		fakeHandler(status, 0).ServeHTTP(w, r)
 	}))
 	defer ts.Close()
+	yc, err = NewTestYubiClient(ts.URL)
+	c.Assert(err, IsNil)
+	res, err = yc.VerifyOTP(colemak)
+	c.Assert(err, IsNil)
+	c.Assert(res.OTP, Equals, otp)
 
-	yc, err := NewTestYubiClient(ts.URL)
+	// typed on Dvorak, with a passcode of Colemak characters too; the public ID is not ModHex as Colemak, so that
+	// the OTP is sent once
+	otp = "cccccccccccb" + "dfghijklnruvdfghijklnruvdfghijkl"
+	var calls int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fakeHandler(common.BAD_OTP, 0).ServeHTTP(w, r)
+	}))
+	defer bad.Close()
+	yc, err = NewTestYubiClient(bad.URL)
+	c.Assert(err, IsNil)
+	candidates, err := common.OTPCandidates(common.LayoutDvorak.FromModHex(otp))
 	c.Assert(err, IsNil)
+	c.Assert(candidates, HasLen, 2)
+	_, err = yc.VerifyOTP(common.LayoutDvorak.FromModHex(otp))
+	c.Assert(err, yubitest.ErrorIs, common.BAD_OTP)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(1))
+}
+
+func (s *yubicoSuite) TestVerifyFanOutReplayedRequest(c *C) {
+	// a server that synced the OTP from its sibling answers first
+	synced := fakeServer(common.REPLAYED_REQUEST, 0)
+	defer synced.Close()
+	good := fakeServer(common.OK, 50*time.Millisecond)
+	defer good.Close()
+
+	yc, err := NewTestYubiClient(good.URL)
+	c.Assert(err, IsNil)
+	yc.servers = []string{synced.URL, good.URL}
+	WithFanOut()(yc)
 
-	// should verify
 	res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
 	c.Assert(err, IsNil)
-	c.Assert(res, NotNil)
+	c.Assert(res.Status, Equals, common.OK)
+	c.Assert(res.Server, Equals, good.URL)
 
-	// should fail unable to look up the yubikey ID
-	res, err = yc.VerifyOTP("unknown ID+2" + yubitest.TestTokens[0].Token(0)[common.TokenIDLen:])
+	// no other answer
+	yc.servers = []string{synced.URL, synced.URL}
+	res, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, yubitest.ErrorIs, common.REPLAYED_REQUEST)
+	c.Assert(res.Status, Equals, common.REPLAYED_REQUEST)
+}
+
+func (s *yubicoSuite) TestVerifyContext(c *C) {
+	slow := fakeServer(common.OK, time.Minute)
+	defer slow.Close()
+
+	yc, err := NewTestYubiClient(slow.URL)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = yc.VerifyOTPContext(ctx, yubitest.TestTokens[0].Token(0))
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+
+	// the client timeout applies when the context has no deadline
+	WithTimeout(50 * time.Millisecond)(yc)
+	_, err = yc.VerifyOTPContext(context.Background(), yubitest.TestTokens[0].Token(0))
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+}
+
+func (s *yubicoSuite) TestTLSOptions(c *C) {
+	ts := httptest.NewTLSServer(fakeHandler(common.OK, 0))
+	defer ts.Close()
+	creds := WithAPICreds("test", "")
+	otp := yubitest.TestTokens[0].Token(0)
+
+	// the test server certificate is not trusted by default
+	yc, err := NewYubiClient(creds, WithAPIServers([]string{ts.URL}))
+	c.Assert(err, IsNil)
+	_, err = yc.VerifyOTP(otp)
 	c.Assert(err, NotNil)
-	c.Assert(err.Error(), Equals, common.NO_SUCH_CLIENT.String())
+
+	yc, err = NewYubiClient(creds, WithAPIServers([]string{ts.URL}), WithHTTPClient(ts.Client()))
+	c.Assert(err, IsNil)
+	_, err = yc.VerifyOTP(otp)
+	c.Assert(err, IsNil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	tlsCfg := &tls.Config{RootCAs: roots}
+	yc, err = NewYubiClient(creds, WithAPIServers([]string{ts.URL}), WithTLSConfig(tlsCfg),
+		WithSPKIPins(SPKIPin(ts.Certificate())))
+	c.Assert(err, IsNil)
+	res, err := yc.VerifyOTP(otp)
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.OK)
+
+	// a pin that does not match the server
+	yc, err = NewYubiClient(creds, WithAPIServers([]string{ts.URL}), WithTLSConfig(tlsCfg),
+		WithSPKIPins(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))))
+	c.Assert(err, IsNil)
+	_, err = yc.VerifyOTP(otp)
+	c.Assert(err, NotNil)
+
+	// the caller's own VerifyConnection still runs with the pins
+	var called int32
+	cbCfg := tlsCfg.Clone()
+	cbCfg.VerifyConnection = func(tls.ConnectionState) error {
+		atomic.AddInt32(&called, 1)
+		return errors.New("refused by caller")
+	}
+	yc, err = NewYubiClient(creds, WithAPIServers([]string{ts.URL}), WithTLSConfig(cbCfg),
+		WithSPKIPins(SPKIPin(ts.Certificate())))
+	c.Assert(err, IsNil)
+	_, err = yc.VerifyOTP(otp)
+	c.Assert(err, ErrorMatches, ".*refused by caller.*")
+	c.Assert(atomic.LoadInt32(&called) > 0, Equals, true)
+
+	// pins must be SHA-256 digests
+	_, err = NewYubiClient(creds, WithSPKIPins("Zm9v"))
+	c.Assert(err, NotNil)
+
+	// TLS options need a transport they can configure
+	rt := http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) { return nil, nil })}
+	_, err = NewYubiClient(creds, WithHTTPClient(&rt), WithTLSConfig(tlsCfg))
+	c.Assert(err, NotNil)
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func (s *yubicoSuite) TestRetryPolicy(c *C) {
+	var calls int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := common.OK
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		case 2:
+			status = common.NOT_ENOUGH_ANSWERS
+		}
+		fakeHandler(status, 0).ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	yc, err := NewTestYubiClient(flaky.URL)
+	c.Assert(err, IsNil)
+	_, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, NotNil)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(1))
+
+	atomic.StoreInt32(&calls, 0)
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2})(yc)
+	res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, IsNil)
+	c.Assert(res.Status, Equals, common.OK)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(3))
+
+	// answers about the OTP are not retried
+	replayed := fakeServer(common.REPLAYED_OTP, 0)
+	defer replayed.Close()
+	yc.servers = []string{replayed.URL}
+	res, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, NotNil)
+	c.Assert(res.Status, Equals, common.REPLAYED_OTP)
+}
+
+func (s *yubicoSuite) TestRetryStoredOTP(c *C) {
+	// the first server stored the OTP but could not sync it; the retry is then a replay
+	var calls int32
+	nonces := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := common.NOT_ENOUGH_ANSWERS
+		if atomic.AddInt32(&calls, 1) > 1 {
+			status = common.REPLAYED_REQUEST
+		}
+		nonces <- r.URL.Query().Get("nonce")
+		fakeHandler(status, 0).ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	yc, err := NewTestYubiClient(ts.URL)
+	c.Assert(err, IsNil)
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})(yc)
+	res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, yubitest.ErrorIs, common.NOT_ENOUGH_ANSWERS)
+	c.Assert(res.Status, Equals, common.NOT_ENOUGH_ANSWERS)
+	c.Assert(atomic.LoadInt32(&calls), Equals, int32(2))
+	c.Assert(<-nonces, Not(Equals), <-nonces)
+}
+
+func (s *yubicoSuite) TestRetryPinMismatch(c *C) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(fakeHandler(common.OK, 0))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	yc, err := NewYubiClient(WithAPICreds("test", ""), WithAPIServers([]string{ts.URL}),
+		WithTLSConfig(&tls.Config{RootCAs: roots}),
+		WithSPKIPins(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	c.Assert(err, IsNil)
+	_, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, ErrorMatches, ".*pinned public key.*")
+	c.Assert(atomic.LoadInt32(&conns), Equals, int32(1))
+
+	// a server that is down is retried
+	ts.Close()
+	c.Assert(isRetryable(context.Background(), nil, err), Equals, false)
+	_, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(isRetryable(context.Background(), nil, err), Equals, true)
+}
+
+func (s *yubicoSuite) TestCircuitBreaker(c *C) {
+	var downCalls int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	good := fakeServer(common.OK, 0)
+	defer good.Close()
+
+	yc, err := NewTestYubiClient(good.URL)
+	c.Assert(err, IsNil)
+	yc.servers = []string{down.URL}
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})(yc)
+	WithCircuitBreaker(CircuitBreaker{Threshold: 2, Cooldown: time.Minute})(yc)
+
+	// both attempts fail and open the circuit
+	_, err = yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+	c.Assert(err, NotNil)
+	c.Assert(atomic.LoadInt32(&downCalls), Equals, int32(2))
+
+	yc.servers = []string{down.URL, good.URL}
+	for i := 0; i < 20; i++ {
+		res, err := yc.VerifyOTP(yubitest.TestTokens[0].Token(0))
+		c.Assert(err, IsNil)
+		c.Assert(res.Server, Equals, good.URL)
+	}
+	c.Assert(atomic.LoadInt32(&downCalls), Equals, int32(2))
+
+	states := yc.ServerStates()
+	c.Assert(len(states), Equals, 2)
+	c.Assert(states[0].Open, Equals, true)
+	c.Assert(states[0].Failures, Equals, 2)
+	c.Assert(states[1].Open, Equals, false)
+	c.Assert(states[1].Failures, Equals, 0)
+
+	// after the cooldown the server is tried again
+	yc.states[down.URL].openUntil = time.Now().Add(-time.Second)
+	c.Assert(len(yc.availableServers()), Equals, 2)
 }